@@ -0,0 +1,18 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+)
+
+// admin wraps fn so that it only runs for requests bearing -admin-token,
+// answering 401 to everyone else.
+func admin(fn HandlerFunc) HandlerFunc {
+	return func(req *Request, params map[string]string) string {
+		scheme, token, _ := strings.Cut(req.Headers["authorization"], " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(adminToken)) != 1 {
+			return createResponse("401 Unauthorized", map[string]string{"WWW-Authenticate": "Bearer"}, "")
+		}
+		return fn(req, params)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cache = fileCache{entries: make(map[string]*cachedFile)}
+
+// fileCache holds file contents in memory, keyed by their path on disk.
+type fileCache struct {
+	mu      sync.RWMutex
+	entries map[string]*cachedFile
+}
+
+type cachedFile struct {
+	data     []byte
+	modTime  time.Time
+	cachedAt time.Time
+}
+
+func (c *fileCache) get(file string) (*cachedFile, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[file]
+	return entry, ok
+}
+
+// load reads file from disk and caches it, replacing any existing entry.
+func (c *fileCache) load(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[file] = &cachedFile{data: data, modTime: info.ModTime(), cachedAt: time.Now()}
+	return nil
+}
+
+func (c *fileCache) remove(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, file)
+}
+
+// flush empties the cache, so every file is read from disk from then on, and
+// returns how many entries it dropped.
+func (c *fileCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
+
+// preload caches each comma-separated name, resolved against -directory the
+// same way /files/{name} is, failing on the first one that can't be read.
+func preload(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		file, err := resolvePath(name)
+		if err != nil {
+			return err
+		}
+		if err := cache.load(file); err != nil {
+			return fmt.Errorf("preloading %s: %w", name, err)
+		}
+		logInfo("Preloaded file: ", name)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withCache empties the file cache when the test ends.
+func withCache(t *testing.T) {
+	t.Cleanup(func() { cache.flush() })
+}
+
+func TestPreload(t *testing.T) {
+	dir := withDir(t)
+	withCache(t)
+	file := filepath.Join(dir, "warm.txt")
+	if err := os.WriteFile(file, []byte("from memory"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := preload("warm.txt, "); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil { // only the cached copy can answer now
+		t.Fatal(err)
+	}
+	if resp, body := do(t, request("GET", "/files/warm.txt", nil)); resp.StatusCode != 200 || body != "from memory" {
+		t.Errorf("got %d %q, want the preloaded content", resp.StatusCode, body)
+	}
+	if err := preload("missing.txt"); err == nil {
+		t.Error("preloading a missing file succeeded")
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	dir := withDir(t)
+	withCache(t)
+	set(t, &cacheAge, true)
+	file := filepath.Join(dir, "warm.txt")
+	if err := os.WriteFile(file, []byte("warm"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := preload("warm.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := cache.get(file)
+	last := -1
+	for i := 0; i < 3; i++ {
+		resp, _ := do(t, request("GET", "/files/warm.txt", nil))
+		age, err := strconv.Atoi(resp.Header.Get("Age"))
+		if err != nil || age <= last {
+			t.Fatalf("hit %d: Age %q, want more than %d", i, resp.Header.Get("Age"), last)
+		}
+		last = age
+		entry.cachedAt = entry.cachedAt.Add(-5 * time.Second) // rather than wait for it to age
+	}
+	if resp, _ := do(t, request("GET", "/", nil)); resp.Header.Get("Age") != "" {
+		t.Errorf("Age %q on a response not from the cache", resp.Header.Get("Age"))
+	}
+}
+
+func TestCachedRange(t *testing.T) {
+	dir := withDir(t)
+	withCache(t)
+	file := filepath.Join(dir, "digits.txt")
+	if err := os.WriteFile(file, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := preload("digits.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil { // only the cached copy can answer now
+		t.Fatal(err)
+	}
+	resp, body := do(t, request("GET", "/files/digits.txt", []string{"Range: bytes=3-6"}))
+	if resp.StatusCode != 206 || resp.Header.Get("Content-Range") != "bytes 3-6/10" || body != "3456" {
+		t.Errorf("got %d %q %q, want 206 bytes 3-6/10 %q", resp.StatusCode, resp.Header.Get("Content-Range"), body, "3456")
+	}
+	if resp, _ := do(t, request("GET", "/files/digits.txt", []string{"Range: bytes=20-"})); resp.StatusCode != 416 || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Errorf("unsatisfiable: got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	dir := withDir(t)
+	withCache(t)
+	set(t, &adminToken, "secret")
+	withRouter(t)
+	file := filepath.Join(dir, "warm.txt")
+	if err := os.WriteFile(file, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := preload("warm.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("new"), 0o644); err != nil { // out of band, so the cache is stale
+		t.Fatal(err)
+	}
+	if resp, _ := do(t, request("POST", "/admin/flush-cache", []string{"Authorization: Bearer wrong"})); resp.StatusCode != 401 {
+		t.Errorf("wrong token: status %d, want 401", resp.StatusCode)
+	}
+	if _, ok := cache.get(file); !ok {
+		t.Fatal("a refused flush emptied the cache")
+	}
+	if resp, _ := do(t, request("POST", "/admin/flush-cache", []string{"Authorization: Bearer secret"})); resp.StatusCode/100 != 2 {
+		t.Errorf("flush: status %d", resp.StatusCode)
+	}
+	if _, ok := cache.get(file); ok {
+		t.Error("the entry is still cached")
+	}
+	if _, body := do(t, request("GET", "/files/warm.txt", nil)); body != "new" {
+		t.Errorf("after the flush: got %q, want the file as it is on disk", body)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etag derives a strong validator from what the file looks like on disk, so
+// it changes whenever the content is replaced.
+func etag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// checkPreconditions evaluates the conditional request headers in the order
+// RFC 7232 section 6 prescribes: If-Match, then If-Unmodified-Since (only
+// without If-Match), then If-None-Match, then If-Modified-Since (only without
+// If-None-Match). It returns the status to answer with instead of the
+// resource, or "" if the request should go ahead.
+func checkPreconditions(req *Request, tag string, modTime time.Time) string {
+	h := req.Headers
+	modTime = modTime.Truncate(time.Second) // HTTP dates have one-second resolution
+	safe := req.Method == "GET" || req.Method == "HEAD"
+
+	if im, ok := h["if-match"]; ok {
+		if !etagMatches(im, tag, true) {
+			return "412 Precondition Failed"
+		}
+	} else if ius, ok := h["if-unmodified-since"]; ok {
+		if t, err := http.ParseTime(ius); err == nil && modTime.After(t) {
+			return "412 Precondition Failed"
+		}
+	}
+
+	if inm, ok := h["if-none-match"]; ok {
+		if etagMatches(inm, tag, false) {
+			if safe {
+				return "304 Not Modified"
+			}
+			return "412 Precondition Failed"
+		}
+	} else if ims, ok := h["if-modified-since"]; ok && safe {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.After(t) {
+			return "304 Not Modified"
+		}
+	}
+	return ""
+}
+
+// etagMatches reports whether tag is in the comma-separated list (or the list
+// is "*"). Strong comparison never matches weak tags; weak comparison ignores
+// the W/ prefix.
+func etagMatches(list string, tag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range header should be honored given the
+// If-Range header, which holds either an entity tag (compared strongly) or a
+// date that must equal the last modification time exactly.
+func ifRangeMatches(req *Request, tag string, modTime time.Time) bool {
+	ir, ok := req.Headers["if-range"]
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return ir == tag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && modTime.Truncate(time.Second).Equal(t)
+}
+
+var (
+	errMalformedRange   = errors.New("malformed Range header")
+	errUnsatisfiedRange = errors.New("no satisfiable range")
+	errTooManyRanges    = errors.New("too many ranges")
+)
+
+// byteRange is a half-open [start, end) span of a representation.
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end-1, size)
+}
+
+// parseRange parses a "bytes=" Range header against a representation of the
+// given size, clamping ranges that run past the end and dropping the ones
+// that start beyond it. A syntax error yields errMalformedRange, which callers
+// handle by ignoring the header; if every range lies outside the
+// representation the error is errUnsatisfiedRange. More than -max-ranges
+// ranges yields errTooManyRanges.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	unit, spec, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errMalformedRange
+	}
+	parts := strings.Split(spec, ",")
+	if maxRanges > 0 && len(parts) > maxRanges {
+		return nil, errTooManyRanges // each one costs a seek and a read, for a few bytes of request
+	}
+	var ranges []byteRange
+	for _, part := range parts {
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errMalformedRange
+		}
+		// Clients are seen sending "bytes = 0 - 9", so whitespace is
+		// tolerated around each number, but the numbers themselves must be
+		// plain digits.
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			// A suffix range: the last n bytes.
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, errMalformedRange
+			}
+			if n == 0 {
+				continue
+			}
+			r = byteRange{max(size-n, 0), size}
+		} else {
+			start, ok := parseDigits(first)
+			if !ok {
+				return nil, errMalformedRange
+			}
+			end := size
+			if last != "" {
+				l, ok := parseDigits(last)
+				if !ok || l < start {
+					return nil, errMalformedRange
+				}
+				end = min(l+1, size)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, end}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiedRange
+	}
+	return ranges, nil
+}
+
+// parseDigits parses s as a non-negative decimal, rejecting the signs and
+// blanks ParseInt would let through or trip over.
+func parseDigits(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
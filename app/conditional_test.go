@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalPrecedence(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := do(t, request("GET", "/files/a.txt", nil))
+	tag := resp.Header.Get("ETag")
+	for _, tc := range []struct {
+		headers []string
+		status  int
+		body    string
+	}{
+		{[]string{"If-None-Match: " + tag, "Range: bytes=0-3", "If-Range: " + tag}, 304, ""},
+		{[]string{"If-None-Match: \"other\"", "Range: bytes=0-3", "If-Range: " + tag}, 206, "0123"},
+		{[]string{"If-None-Match: \"other\"", "Range: bytes=0-3", "If-Range: \"stale\""}, 200, "0123456789"},
+		{[]string{"If-Match: \"other\"", "If-None-Match: " + tag}, 412, ""},
+		{[]string{"If-Match: " + tag, "Range: bytes=4-"}, 206, "456789"},
+	} {
+		resp, body := do(t, request("GET", "/files/a.txt", tc.headers))
+		if resp.StatusCode != tc.status || body != tc.body {
+			t.Errorf("%q: got %d %q, want %d %q", tc.headers, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=-500", []byteRange{{500, 1000}}, nil},
+		{"bytes=-5000", []byteRange{{0, 1000}}, nil},
+		{"bytes=0-", []byteRange{{0, 1000}}, nil},
+		{"bytes = 0 - 9", []byteRange{{0, 10}}, nil},
+		{"bytes=0-9, 990-2000", []byteRange{{0, 10}, {990, 1000}}, nil},
+		{"bytes=1000-", nil, errUnsatisfiedRange},
+		{"bytes=9-0", nil, errMalformedRange},
+		{"bytes=+1-2", nil, errMalformedRange},
+		{"bytes=1", nil, errMalformedRange},
+		{"items=0-9", nil, errMalformedRange},
+	} {
+		got, err := parseRange(tc.header, 1000)
+		if err != tc.err || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseRange(%q) = %v, %v; want %v, %v", tc.header, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestTooManyRanges(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(strings.Repeat("x", 1000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &maxRanges, 5)
+	spec := func(n int) string {
+		ranges := make([]string, n)
+		for i := range ranges {
+			ranges[i] = strconv.Itoa(i) + "-" + strconv.Itoa(i)
+		}
+		return "Range: bytes=" + strings.Join(ranges, ",")
+	}
+	if resp, _ := do(t, request("GET", "/files/a.txt", []string{spec(6)})); resp.StatusCode != 400 {
+		t.Errorf("6 ranges: status %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := do(t, request("GET", "/files/a.txt", []string{spec(5)})); resp.StatusCode == 400 {
+		t.Error("5 ranges were refused")
+	}
+	set(t, &maxRanges, 0)
+	if resp, _ := do(t, request("GET", "/files/a.txt", []string{spec(500)})); resp.StatusCode == 400 {
+		t.Error("-max-ranges 0: 500 ranges were refused")
+	}
+}
+
+func TestIfModifiedSinceFormats(t *testing.T) {
+	dir := withDir(t)
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	later := modTime.Add(time.Hour)
+	for _, tc := range []struct {
+		date   string
+		status int
+	}{
+		{later.Format(http.TimeFormat), 304},
+		{later.Format(time.RFC850), 304},
+		{later.Format(time.ANSIC), 304},
+		{modTime.Add(-time.Hour).Format(http.TimeFormat), 200},
+		{"yesterday", 200},
+		{"", 200},
+	} {
+		if resp, _ := do(t, request("GET", "/files/a.txt", []string{"If-Modified-Since: " + tc.date})); resp.StatusCode != tc.status {
+			t.Errorf("If-Modified-Since %q: status %d, want %d", tc.date, resp.StatusCode, tc.status)
+		}
+	}
+}
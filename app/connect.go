@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// connectDialTimeout bounds how long a CONNECT waits for the upstream.
+const connectDialTimeout = 10 * time.Second
+
+// connect answers a CONNECT request. Unless -connect-tunnel is set the server
+// isn't a proxy, which it says with a 405. Otherwise it opens a TCP tunnel to
+// the host:port target and returns "" once either side hangs up.
+func connect(req *Request) string {
+	if !connectTunnel {
+		allowed := router.Allowed(req.Path) // a path target might name a resource that has methods
+		return createResponse("405 Method Not Allowed", map[string]string{"Allow": strings.Join(allowed, ", ")}, "")
+	}
+	if _, _, err := net.SplitHostPort(req.Target); err != nil || strings.HasPrefix(req.Target, "/") {
+		return createResponse("400 Bad Request", nil, "") // CONNECT takes host:port, nothing else
+	}
+	upstream, err := net.DialTimeout("tcp", req.Target, connectDialTimeout)
+	if err != nil {
+		logWarn("Error dialing CONNECT target: ", err)
+		return createResponse("502 Bad Gateway", nil, "")
+	}
+	defer upstream.Close()
+
+	con := req.conn
+	con.SetDeadline(time.Time{}) // the tunnel is idle for as long as its ends like
+	if err := writeAll(con, []byte("HTTP/1.1 200 Connection Established\r\nX-Request-Id: "+req.ID+"\r\n\r\n")); err != nil {
+		return ""
+	}
+	con.SetWriteDeadline(time.Time{})
+	logDebug("Tunneling to", req.Target)
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, req.reader) // starting with anything the client sent early
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(con, upstream)
+		done <- struct{}{}
+	}()
+	<-done // one direction ended; the deferred close and the caller's end the other
+	return ""
+}
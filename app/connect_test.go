@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnect(t *testing.T) {
+	if resp, _ := do(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nConnection: close\r\n\r\n"); resp.StatusCode != 405 {
+		t.Errorf("without -connect-tunnel: status %d, want 405", resp.StatusCode)
+	}
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		c, err := upstream.Accept()
+		if err == nil {
+			io.Copy(c, c) // echo
+			c.Close()
+		}
+	}()
+	set(t, &connectTunnel, true)
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	target := upstream.Addr().String()
+	go io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %v, %v; want a 200", resp, err)
+	}
+	go io.WriteString(c, "through the tunnel")
+	got := make([]byte, len("through the tunnel"))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "through the tunnel" {
+		t.Errorf("echoed %q, %v", got, err)
+	}
+	if resp, _ := do(t, "CONNECT /files/x HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"); resp.StatusCode != 400 {
+		t.Errorf("a path target: status %d, want 400", resp.StatusCode)
+	}
+}
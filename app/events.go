@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Bounds on /events, for the same reason as /drip's.
+const (
+	maxEvents        = 1000
+	maxEventInterval = time.Minute
+)
+
+// events streams a tick as a server-sent event every interval (default 1s),
+// count times (default 10), then ends the response. It stops early as soon as
+// the client goes away.
+func events(req *Request) error {
+	con := req.conn
+	query, err := url.ParseQuery(req.Query)
+	if err != nil {
+		return writeStatus(req, "400 Bad Request")
+	}
+	count, interval := 10, time.Second
+	if v := query.Get("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count < 0 || count > maxEvents {
+			return writeStatus(req, "400 Bad Request")
+		}
+	}
+	if v := query.Get("interval"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		interval = time.Duration(seconds * float64(time.Second))
+		if err != nil || interval < 0 || interval > maxEventInterval {
+			return writeStatus(req, "400 Bad Request")
+		}
+	}
+
+	chunked := req.Version != "HTTP/1.0"
+	head := "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\nX-Request-Id: " + req.ID + "\r\n"
+	if chunked {
+		head += "Transfer-Encoding: chunked\r\n"
+	}
+	if err := writeAll(con, []byte(head+"\r\n")); err != nil {
+		return err
+	}
+	if req.Method == "HEAD" {
+		return nil
+	}
+
+	// The connection ends with this response, so nothing else reads from it:
+	// a read returning means the client hung up (or sent something we ignore).
+	gone := make(chan struct{})
+	go func() {
+		con.Read(make([]byte, 1))
+		close(gone)
+	}()
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+	for i := 1; i <= count; i++ {
+		select {
+		case <-gone:
+			logDebug("Event stream client went away after", i-1, "events")
+			return nil
+		case now := <-ticker.C:
+			event := fmt.Sprintf("id: %d\nevent: tick\ndata: %s\n\n", i, now.UTC().Format(time.RFC3339Nano))
+			if chunked {
+				event = fmt.Sprintf("%x\r\n%s\r\n", len(event), event)
+			}
+			if err := writeAll(con, []byte(event)); err != nil {
+				return err
+			}
+		}
+	}
+	if !chunked {
+		return nil // the caller closing con ends the body
+	}
+	return writeAll(con, []byte("0\r\n\r\n"))
+}
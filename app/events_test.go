@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	c, done := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go c.Write([]byte(request("GET", "/events?count=1000&interval=0.01", nil)))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for _, want := range []string{"id: 1", "event: tick", "data: ", "", "id: 2", "event: tick", "data: ", ""} {
+		if !lines.Scan() || !strings.HasPrefix(lines.Text(), want) || want == "" && lines.Text() != "" {
+			t.Fatalf("got line %q, want %q: %v", lines.Text(), want, lines.Err())
+		}
+	}
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("the stream kept going after the client hung up")
+	}
+}
+
+func TestEventsHTTP10(t *testing.T) {
+	out := exchange(t, "GET /events?count=2&interval=0 HTTP/1.0\r\n\r\n")
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	if strings.Contains(head, "Transfer-Encoding") {
+		t.Errorf("head is %q, want no chunked encoding for HTTP/1.0", head)
+	}
+	if !strings.HasPrefix(body, "id: 1\n") || !strings.Contains(body, "\n\nid: 2\n") || !strings.HasSuffix(body, "\n\n") {
+		t.Errorf("body is %q, want two bare events", body)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func returnFileIfExists(file string, req *Request) string {
+	fullFile, err := resolvePath(file)
+	if err != nil {
+		logWarn("Refusing to serve: ", err)
+		return notFound()
+	}
+	if dirListing != "" {
+		if info, err := os.Stat(fullFile); err == nil && info.IsDir() {
+			return listDirectory(fullFile, req)
+		}
+	}
+	return serveFile(fullFile, req)
+}
+
+// resolvePath maps a /files/{name} name onto -directory, refusing names that
+// climb out of it with "..".
+func resolvePath(name string) (string, error) {
+	root := directory
+	if root == "" {
+		root = "."
+	}
+	full := filepath.Join(root, name)
+	if root == "." {
+		if full == ".." || strings.HasPrefix(full, ".."+string(filepath.Separator)) || filepath.IsAbs(full) {
+			return "", fmt.Errorf("%q escapes the working directory", name)
+		}
+		return full, nil
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator) // Clean leaves a trailing separator only on the filesystem root
+	}
+	if full != root && !strings.HasPrefix(full, prefix) {
+		return "", fmt.Errorf("%q escapes %s", name, root)
+	}
+	return full, nil
+}
+
+// maxCompressSize is the largest file serveFile will gzip, since that means
+// holding it in memory; anything bigger is streamed as it is.
+const maxCompressSize = 8 << 20
+
+// serveFile answers a GET or HEAD for file, honoring conditional headers and
+// a single-range Range header. Requests for several ranges get the whole file.
+// The body is streamed from disk unless it's cached or being gzipped.
+func serveFile(file string, req *Request) string {
+	source, encoding := file, ""
+	// Held only while the file is found and opened, so a DELETE or upload
+	// doesn't wait on a slow download; the open descriptor keeps reading
+	// what was there even once the name is removed or replaced.
+	unlock := fileLocks.rlock(file)
+	entry, cached := cache.get(file)
+	var size int64
+	var modTime time.Time
+	if cached {
+		size, modTime = int64(len(entry.data)), entry.modTime
+	} else {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			unlock()
+			logDebug("File does not exist: ", file)
+			return notFound()
+		}
+		size, modTime = info.Size(), info.ModTime()
+	}
+	logDebug("File found: ", file)
+	if precompressed {
+		if coding, sidecar, info := findSidecar(file, acceptEncoding(req.Headers)); sidecar != "" {
+			// The sidecar is another representation, with its own size and
+			// validators; only the Content-Type still comes from file.
+			source, encoding, cached = sidecar, coding, false
+			size, modTime = info.Size(), info.ModTime()
+			logDebug("Serving sidecar: ", sidecar)
+		}
+	}
+	var f *os.File
+	var release func() // closes f, unless a streamed body takes it over
+	if !cached {
+		var err error
+		f, release, err = openFile(source)
+		if err != nil {
+			unlock()
+			logError("Error reading file: ", source, err.Error())
+			return createResponse("500 Internal Server Error", nil, "")
+		}
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
+	}
+	unlock()
+
+	tag := etag(size, modTime)
+	if encoding != "" {
+		tag = strings.TrimSuffix(tag, `"`) + "-" + encoding + `"` // sidecars can match each other in size and time
+	}
+	headers := map[string]string{"ETag": tag,
+		"Last-Modified": modTime.UTC().Format(http.TimeFormat),
+		"Accept-Ranges": "bytes"}
+	if cacheControl != "" {
+		headers["Cache-Control"] = cacheControl
+	}
+	if cached && cacheAge {
+		// The validators above already describe the cached copy, which may
+		// be older than what's on disk.
+		headers["Age"] = strconv.Itoa(int(time.Since(entry.cachedAt).Seconds()))
+	}
+	if status := checkPreconditions(req, tag, modTime); status != "" {
+		return createResponse(status, headers, "")
+	}
+
+	status, span := "200 OK", byteRange{0, size}
+	if rangeHeader, ok := req.Headers["range"]; ok && ifRangeMatches(req, tag, modTime) {
+		ranges, err := parseRange(rangeHeader, size)
+		switch {
+		case err == errTooManyRanges:
+			return createResponse("400 Bad Request", nil, "")
+		case err == errUnsatisfiedRange:
+			headers["Content-Range"] = fmt.Sprintf("bytes */%d", size)
+			return createResponse("416 Range Not Satisfiable", headers, "")
+		case err == nil && len(ranges) == 1:
+			status, span = "206 Partial Content", ranges[0]
+			headers["Content-Range"] = span.contentRange(size)
+		}
+	}
+	headers["Content-Type"] = contentType(file)
+	headers["Content-Length"] = strconv.FormatInt(span.end-span.start, 10)
+	compress := status == "200 OK" && encoding == ""
+	if compress || precompressed {
+		headers["Vary"] = "Accept-Encoding"
+	}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	// A GET that would be gzipped has a Content-Length only known by
+	// compressing, so HEAD has to do that too to report the same one.
+	gzipped := compress && size <= maxCompressSize && compressible(headers["Content-Type"]) && acceptsGzip(acceptEncoding(req.Headers))
+	if req.Method == "HEAD" && !gzipped {
+		return createResponse(status, headers, "") // same headers as GET, without reading the file
+	}
+
+	var data []byte
+	if cached {
+		data = entry.data[span.start:span.end]
+	} else if gzipped {
+		data = make([]byte, span.end-span.start)
+		if _, err := f.ReadAt(data, span.start); err != nil {
+			logError("Error reading file: ", source, err.Error())
+			return createResponse("500 Internal Server Error", nil, "")
+		}
+	} else {
+		done := release
+		release = nil
+		n := span.end - span.start
+		return stream(req, &Response{Status: status, Headers: headers, Body: io.NewSectionReader(f, span.start, n), ContentLength: n, done: done})
+	}
+	body := string(data)
+	if gzipped {
+		body = compressBody(body, acceptEncoding(req.Headers), headers)
+		headers["Content-Length"] = strconv.Itoa(len(body))
+	}
+	return createResponse(status, headers, body)
+}
+
+// sidecarCodings are the -precompressed sidecar extensions, best first: br
+// wins a tie with gzip, since it compresses smaller.
+var sidecarCodings = []struct{ coding, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+// findSidecar picks the sidecar of file to serve under -precompressed: of those
+// that exist, the one whose coding acceptEncoding gives the highest q-value.
+// It returns an empty path when the client accepts none of them.
+func findSidecar(file string, acceptEncoding string) (coding string, path string, info os.FileInfo) {
+	best := 0.0
+	for _, c := range sidecarCodings {
+		q := codingQuality(acceptEncoding, c.coding)
+		if q <= best {
+			continue
+		}
+		fi, err := os.Stat(file + c.ext)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		best, coding, path, info = q, c.coding, file+c.ext, fi
+	}
+	return coding, path, info
+}
+
+// codingQuality returns the q-value acceptEncoding gives coding, falling back
+// to a "*" entry, or 0 if neither is listed.
+func codingQuality(acceptEncoding string, coding string) float64 {
+	q, star := -1.0, 0.0
+	for _, member := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(member, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		value := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				value = f
+			}
+		}
+		if name == coding {
+			q = value
+		} else {
+			star = value
+		}
+	}
+	if q < 0 {
+		return star
+	}
+	return q
+}
+
+// openFile opens file for reading at offsets, from the shared handles under
+// -share-file-handles. release gives the file back.
+func openFile(file string) (f *os.File, release func(), err error) {
+	if shareFileHandles {
+		return sharedFiles.open(file)
+	}
+	f, err = os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// mimeTypes covers extensions the system MIME table is often missing or
+// wrong about. It's consulted before mime.TypeByExtension, and -mime-type
+// adds to or overrides it.
+var mimeTypes = map[string]string{
+	".mjs":         "text/javascript",
+	".svg":         "image/svg+xml",
+	".vtt":         "text/vtt",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".woff2":       "font/woff2",
+}
+
+// extMap is a repeatable flag of ".ext=value" pairs.
+type extMap map[string]string
+
+func (m extMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m extMap) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(k, ".") || v == "" {
+		return fmt.Errorf("expected .ext=value, got %q", s)
+	}
+	m[strings.ToLower(k)] = v
+	return nil
+}
+
+// contentType picks a Content-Type from the file's extension, tagging text
+// types with the configured charset.
+func contentType(file string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	t, ok := mimeTypes[ext]
+	if !ok {
+		t = mime.TypeByExtension(ext)
+	}
+	if t == "" {
+		return "application/octet-stream"
+	}
+	t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) // drop whatever charset the system table carries
+	if strings.HasPrefix(t, "text/") && charset != "" {
+		t += "; charset=" + charset
+	}
+	return t
+}
+
+// uploadSlots limits simultaneous uploads to -max-uploads; nil means no limit.
+var uploadSlots chan struct{}
+
+// createFile stores body as file under -directory. The caller holds one of the
+// -max-uploads slots.
+func createFile(file string, body io.Reader) string {
+	logDebug("CREATING FILE!")
+	fullFile, err := resolvePath(file)
+	if err != nil {
+		logWarn("Refusing to write: ", err)
+		return createResponse("400 Bad Request", nil, "")
+	}
+	dir := uploadTmpDir
+	if dir == "" {
+		dir = filepath.Dir(fullFile)
+	}
+	tmp, n, err := writeTemp(dir, body, nil)
+	if err != nil {
+		logError("Error writing file: ", file, err.Error())
+		return uploadFailed(err)
+	}
+	defer os.Remove(tmp) // a no-op once the rename has happened
+	// Each upload has its own temp file, so only the rename is locked:
+	// concurrent uploads to the same name land whole, one after another,
+	// without a slow client holding up the rest.
+	unlock := fileLocks.lock(fullFile)
+	defer unlock()
+	if _, ok := cache.get(fullFile); ok {
+		defer cache.load(fullFile) // refresh the cached copy once the new content is on disk
+	}
+	if err := os.Rename(tmp, fullFile); err != nil {
+		logError("Error creating file: ", file, err.Error())
+		return uploadFailed(err)
+	}
+	sharedFiles.forget(fullFile) // later readers need a handle on the new file
+	logInfo("Created file:", file, "of", n, "bytes")
+	return createResponse("201 Created", nil, "")
+}
+
+// createAddressed stores body under the hex SHA-256 of its content, for
+// -content-addressed uploads to /files. The same content uploaded again is
+// stored once: it gets 200 instead of 201, with the same Location.
+func createAddressed(body io.Reader) string {
+	release, ok := takeUploadSlot()
+	if !ok {
+		logWarn("Too many uploads in progress, rejecting content-addressed upload")
+		return createResponse("503 Service Unavailable", nil, "")
+	}
+	defer release()
+	dir := uploadTmpDir
+	if dir == "" {
+		dir, _ = resolvePath("")
+	}
+	hash := sha256.New()
+	tmp, n, err := writeTemp(dir, body, hash)
+	if err != nil {
+		logError("Error writing content-addressed upload: ", err.Error())
+		return uploadFailed(err)
+	}
+	defer os.Remove(tmp) // a no-op once the rename has happened
+	name := hex.EncodeToString(hash.Sum(nil))
+	fullFile, _ := resolvePath(name) // a hex name can't escape
+	headers := map[string]string{"Location": "/files/" + name}
+
+	unlock := fileLocks.lock(fullFile)
+	defer unlock()
+	if _, err := os.Stat(fullFile); err == nil {
+		logDebug("Already stored: ", name)
+		return createResponse("200 OK", headers, "")
+	}
+	if err := os.Rename(tmp, fullFile); err != nil {
+		logError("Error creating file: ", name, err.Error())
+		return uploadFailed(err)
+	}
+	logInfo("Created file:", name, "of", n, "bytes")
+	return createResponse("201 Created", headers, "")
+}
+
+// deleteFile removes file from -directory, along with any cached copy. Reads
+// already in progress aren't cut short, as they hold the file open.
+func deleteFile(file string) string {
+	fullFile, err := resolvePath(file)
+	if err != nil {
+		logWarn("Refusing to delete: ", err)
+		return createResponse("400 Bad Request", nil, "")
+	}
+	unlock := fileLocks.lock(fullFile)
+	defer unlock()
+	info, err := os.Stat(fullFile)
+	if err != nil {
+		logDebug("File does not exist: ", file)
+		return notFound()
+	}
+	if info.IsDir() {
+		logInfo("Refusing to delete directory: ", file)
+		return createResponse("400 Bad Request", nil, "")
+	}
+	if err := os.Remove(fullFile); err != nil {
+		logError("Error deleting file: ", file, err.Error())
+		return createResponse("500 Internal Server Error", nil, "")
+	}
+	cache.remove(fullFile)
+	sharedFiles.forget(fullFile)
+	logInfo("Deleted file: ", file)
+	return createResponse("204 No Content", nil, "")
+}
+
+// uploadFailed answers an upload that couldn't be stored. Its temp file is
+// removed either way, so a full disk isn't left fuller.
+func uploadFailed(err error) string {
+	if errors.Is(err, errQuotaExceeded) || errors.Is(err, errRequestTooLarge) {
+		return createResponse("413 Content Too Large", nil, "")
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return createResponse("507 Insufficient Storage", nil, "") // the client's request was fine; retrying elsewhere or later may work
+	}
+	return createResponse("400 Bad Request", nil, "")
+}
+
+// takeUploadSlot claims one of the -max-uploads slots, reporting false if
+// they're all taken. release gives it back.
+func takeUploadSlot() (release func(), ok bool) {
+	if uploadSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case uploadSlots <- struct{}{}:
+		return func() { <-uploadSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// writeTemp copies body into a new temp file in dir, which the caller renames
+// into place or removes, so readers never see a half-written upload. If also
+// is set it sees every byte written.
+func writeTemp(dir string, body io.Reader, also io.Writer) (name string, n int64, err error) {
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	var w io.Writer = f
+	if also != nil {
+		w = io.MultiWriter(f, also)
+	}
+	// Hiding ReadFrom keeps io.CopyBuffer from bypassing the buffer.
+	n, err = io.CopyBuffer(struct{ io.Writer }{w}, body, make([]byte, uploadBufferSize))
+	if err == nil {
+		err = f.Chmod(0o644) // CreateTemp makes files private, uploads are meant to be served
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", n, err
+	}
+	return f.Name(), n, nil
+}
+
+// checkTmpDir makes sure a file created in -tmp-dir can be renamed into
+// -directory, which fails if they're on different filesystems.
+func checkTmpDir() error {
+	f, err := os.CreateTemp(uploadTmpDir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	target := filepath.Join(directory, filepath.Base(f.Name()))
+	if err := os.Rename(f.Name(), target); err != nil {
+		return fmt.Errorf("-tmp-dir must be on the same filesystem as -directory: %w", err)
+	}
+	return os.Remove(target)
+}
+
+// minUploadBufferSize is the smallest -upload-buffer-size; below it the syscall
+// per copy dominates.
+const minUploadBufferSize = 1024
+
+var fileLocks = keyedMutex{locks: make(map[string]*refMutex)}
+
+// keyedMutex hands out one reader/writer lock per key, dropping it once nobody
+// holds or waits on it so the map doesn't grow with every file ever written.
+// Writes and deletes take it exclusively; reads share it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.RWMutex
+	refs int
+}
+
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	m := k.ref(key)
+	m.Lock()
+	return func() {
+		m.Unlock()
+		k.unref(key, m)
+	}
+}
+
+// rlock is lock for readers, any number of which can hold it at once.
+func (k *keyedMutex) rlock(key string) (unlock func()) {
+	m := k.ref(key)
+	m.RLock()
+	return func() {
+		m.RUnlock()
+		k.unref(key, m)
+	}
+}
+
+func (k *keyedMutex) ref(key string) *refMutex {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	return m
+}
+
+func (k *keyedMutex) unref(key string, m *refMutex) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(k.locks, key)
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestDeleteDuringDownload deletes a file while a GET of it is stalled on a
+// client that isn't reading: the DELETE mustn't wait for the download, which
+// still gets every byte of the file as it was.
+func TestDeleteDuringDownload(t *testing.T) {
+	dir := withDir(t)
+	set(t, &allowDelete, true)
+	withRouter(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // far more than the write buffer
+	if err := os.WriteFile(filepath.Join(dir, "big"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, request("GET", "/files/big", nil)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET: status %d, want 200", resp.StatusCode)
+	}
+	got := make([]byte, 100) // then stop reading, leaving the server blocked mid-body
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := do(t, request("DELETE", "/files/big", nil)); resp.StatusCode != 204 {
+		t.Fatalf("DELETE: status %d, want 204", resp.StatusCode)
+	}
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(got, rest...), data) {
+		t.Errorf("GET got %d bytes that differ from the file's %d", len(got)+len(rest), len(data))
+	}
+	if resp, _ := do(t, request("GET", "/files/big", nil)); resp.StatusCode != 404 {
+		t.Errorf("GET after DELETE: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDeleteNeedsFlagAndDirectory(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "keep"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		allow bool
+		dir   string
+	}{{false, dir}, {true, ""}} {
+		set(t, &allowDelete, tc.allow)
+		set(t, &directory, tc.dir)
+		withRouter(t)
+		if resp, _ := do(t, request("DELETE", "/files/keep", nil)); resp.StatusCode != 405 {
+			t.Errorf("-allow-delete=%v -directory=%q: status %d, want 405", tc.allow, tc.dir, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep")); err != nil {
+		t.Errorf("file was deleted: %v", err)
+	}
+}
+
+// TestConcurrentUploads POSTs different content to one name at once: every
+// upload succeeds, and the file ends up holding exactly one of them.
+func TestConcurrentUploads(t *testing.T) {
+	dir := withDir(t)
+	const uploads = 20
+	bodies := make(map[string]bool)
+	var wg sync.WaitGroup
+	statuses := make(chan int, uploads)
+	for i := 0; i < uploads; i++ {
+		body := strings.Repeat(strconv.Itoa(i), 10000+i)
+		bodies[body] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dial(t)
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			go io.WriteString(c, request("POST", "/files/same", nil, body))
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != 201 {
+			t.Errorf("upload: status %d, want 201", status)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bodies[string(got)] {
+		t.Errorf("file holds %d bytes that aren't any one upload", len(got))
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, ".upload-*")); len(temps) > 0 {
+		t.Errorf("temp files left behind: %v", temps)
+	}
+}
+
+// TestSlowUploadDoesNotBlock finishes an upload to a name while another one to
+// it is stalled partway through its body.
+func TestSlowUploadDoesNotBlock(t *testing.T) {
+	dir := withDir(t)
+	slow := dial(t)
+	slow.SetDeadline(time.Now().Add(5 * time.Second))
+	head := "POST /files/same HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\n"
+	if _, err := io.WriteString(slow, head+"slow"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := do(t, request("POST", "/files/same", nil, "fast")); resp.StatusCode != 201 {
+		t.Fatalf("second upload: status %d, want 201", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "same")); string(got) != "fast" {
+		t.Errorf("file holds %q, want %q", got, "fast")
+	}
+	if _, err := io.WriteString(slow, "-done"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(slow), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Errorf("slow upload: status %d, want 201", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "same")); string(got) != "slow-done" {
+		t.Errorf("file holds %q, want %q", got, "slow-done")
+	}
+}
+
+func TestFileRoute(t *testing.T) {
+	icon := filepath.Join(t.TempDir(), "icon.ico")
+	if err := os.WriteFile(icon, []byte("ICON"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &fileRoutes, pathMap{"/favicon.ico": icon})
+	withRouter(t)
+	resp, body := do(t, request("GET", "/favicon.ico", nil))
+	if resp.StatusCode != 200 || body != "ICON" {
+		t.Errorf("got %d %q, want the mapped file", resp.StatusCode, body)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	withDir(t)
+	set(t, &dirListing, "json")
+	for policy, want := range map[string]struct{ from, to string }{"add": {"/files", "/files/"}, "strip": {"/files/", "/files"}} {
+		set(t, &trailingSlash, policy)
+		withRouter(t)
+		resp, _ := do(t, request("GET", want.from, nil))
+		if resp.StatusCode != 301 || resp.Header.Get("Location") != want.to {
+			t.Errorf("-trailing-slash=%s: GET %s got %d to %q, want 301 to %s", policy, want.from, resp.StatusCode, resp.Header.Get("Location"), want.to)
+		}
+		if resp, _ := do(t, request("GET", resp.Header.Get("Location"), nil)); resp.StatusCode != 200 {
+			t.Errorf("-trailing-slash=%s: following the redirect to %s got %d, want the listing", policy, want.to, resp.StatusCode)
+		}
+	}
+}
+
+func TestHeadMissingFile(t *testing.T) {
+	withDir(t)
+	out := exchange(t, request("HEAD", "/files/missing", nil))
+	resps := parseResponses(t, out, "HEAD")
+	if len(resps) != 1 || resps[0].StatusCode != 404 {
+		t.Fatalf("got %q, want one 404", out)
+	}
+	if _, body, _ := strings.Cut(out, "\r\n\r\n"); body != "" {
+		t.Errorf("HEAD response has body %q", body)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>hi</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := do(t, request("GET", "/files/index.html", nil)); resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type %q, want text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	}
+	set(t, &charset, "")
+	if resp, _ := do(t, request("GET", "/files/index.html", nil)); resp.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("-charset empty: Content-Type %q, want text/html", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestMimeTypes(t *testing.T) {
+	for file, want := range map[string]string{"a.wasm": "application/wasm", "a.svg": "image/svg+xml", "a.vtt": "text/vtt; charset=utf-8", "a.unknownext": "application/octet-stream"} {
+		if got := contentType(file); got != want {
+			t.Errorf("contentType(%q) = %q, want %q", file, got, want)
+		}
+	}
+	types := extMap{}
+	for k, v := range mimeTypes {
+		types[k] = v
+	}
+	set(t, &mimeTypes, map[string]string(types))
+	if err := types.Set(".WASM=application/x-custom"); err != nil {
+		t.Fatal(err)
+	}
+	if got := contentType("a.wasm"); got != "application/x-custom" {
+		t.Errorf("with -mime-type: contentType(a.wasm) = %q", got)
+	}
+	if err := types.Set("wasm=x/y"); err == nil {
+		t.Error("-mime-type without a leading dot was accepted")
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := do(t, request("GET", "/files/a.txt", nil)); resp.Header.Get("Cache-Control") != "" {
+		t.Errorf("Cache-Control %q with no -cache-control", resp.Header.Get("Cache-Control"))
+	}
+	set(t, &cacheControl, "public, max-age=3600")
+	if resp, _ := do(t, request("GET", "/files/a.txt", nil)); resp.Header.Get("Cache-Control") != cacheControl {
+		t.Errorf("Cache-Control %q, want %q", resp.Header.Get("Cache-Control"), cacheControl)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := do(t, request("GET", "/files/a.txt", nil))
+	out := exchange(t, request("GET", "/files/a.txt", []string{"If-None-Match: " + resp.Header.Get("ETag")}))
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	if !strings.HasPrefix(head, "HTTP/1.1 304 ") || !strings.Contains(head, "\r\nETag: ") {
+		t.Fatalf("got %q, want a 304 with the ETag", out)
+	}
+	if strings.Contains(head, "Content-Length") || body != "" {
+		t.Errorf("304 has Content-Length or body: %q", out)
+	}
+}
+
+// TestTmpDir stalls an upload partway to find its temp file in -tmp-dir, not
+// -directory, then lets it finish and land.
+func TestTmpDir(t *testing.T) {
+	dir := withDir(t)
+	tmp := t.TempDir()
+	set(t, &uploadTmpDir, tmp)
+	if err := checkTmpDir(); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, "POST /files/up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nhalf-"); err != nil {
+		t.Fatal(err)
+	}
+	var temps []string
+	for deadline := time.Now().Add(2 * time.Second); len(temps) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		temps, _ = filepath.Glob(filepath.Join(tmp, ".upload-*"))
+	}
+	if len(temps) != 1 {
+		t.Fatalf("temp files in -tmp-dir: %v, want one", temps)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("-directory holds %v mid-upload", entries)
+	}
+	if _, err := io.WriteString(c, "done!"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || resp.StatusCode != 201 {
+		t.Fatalf("got %v, %v; want a 201", resp, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "up")); string(got) != "half-done!" {
+		t.Errorf("file holds %q", got)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) > 0 {
+		t.Errorf("-tmp-dir still holds %v", left)
+	}
+}
+
+func TestDirectoryTrailingSlash(t *testing.T) {
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{dir, dir + string(filepath.Separator)} {
+		set(t, &directory, root)
+		if resp, body := do(t, request("GET", "/files/a.txt", nil)); resp.StatusCode != 200 || body != "a" {
+			t.Errorf("-directory %q: got %d %q, want the file", root, resp.StatusCode, body)
+		}
+		for _, name := range []string{"../x", "..", "../" + filepath.Base(dir) + "-sibling/x"} {
+			if full, err := resolvePath(name); err == nil {
+				t.Errorf("-directory %q: %q resolved to %s", root, name, full)
+			}
+		}
+		if full, err := resolvePath("sub/../a.txt"); err != nil || full != filepath.Join(dir, "a.txt") {
+			t.Errorf("-directory %q: sub/../a.txt resolved to %q, %v", root, full, err)
+		}
+	}
+}
+
+// TestLargeUploadStreams uploads 64 MiB and checks the server allocated a
+// small fraction of that, so the body went to disk as it arrived.
+func TestLargeUploadStreams(t *testing.T) {
+	dir := withDir(t)
+	const size = 64 << 20
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	go func() {
+		io.WriteString(c, "POST /files/big HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(size)+"\r\n\r\n")
+		chunk := bytes.Repeat([]byte("x"), 32<<10)
+		for n := 0; n < size; n += len(chunk) {
+			if _, err := c.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if resp.StatusCode != 201 {
+		t.Fatalf("status %d, want 201", resp.StatusCode)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "big")); err != nil || info.Size() != size {
+		t.Fatalf("stat: %v, %v", info, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("allocated %d bytes for a %d-byte upload", allocated, size)
+	}
+}
+
+func TestMaxUploads(t *testing.T) {
+	dir := withDir(t)
+	set(t, &uploadSlots, make(chan struct{}, 2))
+	var stalled []net.Conn
+	for _, name := range []string{"a", "b"} {
+		c := dial(t)
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(c, "POST /files/"+name+" HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nha"); err != nil {
+			t.Fatal(err)
+		}
+		stalled = append(stalled, c)
+	}
+	for deadline := time.Now().Add(2 * time.Second); len(uploadSlots) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d uploads hold a slot, want 2", len(uploadSlots))
+		}
+	}
+	if resp, _ := do(t, request("POST", "/files/c", nil, "data")); resp.StatusCode != 503 {
+		t.Errorf("over the limit: status %d, want 503", resp.StatusCode)
+	}
+	for _, c := range stalled {
+		if _, err := io.WriteString(c, "lf"); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || resp.StatusCode != 201 {
+			t.Errorf("stalled upload: got %v, %v; want a 201", resp, err)
+		}
+	}
+	if resp, _ := do(t, request("POST", "/files/c", nil, "data")); resp.StatusCode != 201 {
+		t.Errorf("once the slots are free: status %d, want 201", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	out := exchange(t, request("GET", "/favicon.ico", nil))
+	if !strings.HasPrefix(out, "HTTP/1.1 204 ") || strings.Contains(out, "Content-Length") || !strings.HasSuffix(out, "\r\n\r\n") {
+		t.Errorf("without -favicon: got %q, want a bare 204", out)
+	}
+	icon := filepath.Join(t.TempDir(), "favicon.ico")
+	if err := os.WriteFile(icon, []byte("ICON"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &favicon, icon)
+	if resp, body := do(t, request("GET", "/favicon.ico", nil)); resp.StatusCode != 200 || body != "ICON" {
+		t.Errorf("with -favicon: got %d %q, want the file", resp.StatusCode, body)
+	}
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	dir := withDir(t)
+	data := make([]byte, 10<<10)
+	for i := range data {
+		data[i] = byte(i * 7) // every byte value, no line structure
+	}
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		io.WriteString(c, "POST /files/ten HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10240\r\n\r\n")
+		for i := 0; i < len(data); i += 3000 { // in pieces, as a client's segments might arrive
+			c.Write(data[i:min(i+3000, len(data))])
+		}
+	}()
+	if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || resp.StatusCode != 201 {
+		t.Fatalf("got %v, %v; want a 201", resp, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "ten")); !bytes.Equal(got, data) {
+		t.Errorf("file holds %d bytes that differ from the %d uploaded", len(got), len(data))
+	}
+	if _, body := do(t, request("GET", "/files/ten", nil)); body != string(data) {
+		t.Errorf("GET returned %d bytes that differ from the %d uploaded", len(body), len(data))
+	}
+}
+
+func TestBinaryContentLength(t *testing.T) {
+	dir := withDir(t)
+	files := map[string]string{"utf8.txt": "héllo, wörld ✓", "bin": "\x00\xff\xfe\x80\r\n\x00"}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		resp, body := do(t, request("GET", "/files/"+name, nil))
+		if resp.Header.Get("Content-Length") != strconv.Itoa(len(data)) || body != data {
+			t.Errorf("%s: Content-Length %q and body %q, want %d bytes %q", name, resp.Header.Get("Content-Length"), body, len(data), data)
+		}
+	}
+	ua := "agent-ü-✓"
+	if resp, body := do(t, request("GET", "/user-agent", []string{"User-Agent: " + ua})); resp.Header.Get("Content-Length") != strconv.Itoa(len(ua)) || body != ua {
+		t.Errorf("/user-agent: Content-Length %q and body %q", resp.Header.Get("Content-Length"), body)
+	}
+}
+
+func TestCompressTypes(t *testing.T) {
+	dir := withDir(t)
+	data := strings.Repeat(`{"compressible": true}`, 200)
+	for _, name := range []string{"a.jpg", "a.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, body := do(t, request("GET", "/files/a.jpg", []string{"Accept-Encoding: gzip"})); resp.Header.Get("Content-Encoding") != "" || body != data {
+		t.Errorf("JPEG: Content-Encoding %q, want none", resp.Header.Get("Content-Encoding"))
+	}
+	if resp, body := do(t, request("GET", "/files/a.json", []string{"Accept-Encoding: gzip"})); resp.Header.Get("Content-Encoding") != "gzip" || len(body) >= len(data) {
+		t.Errorf("JSON: Content-Encoding %q for %d bytes, want gzip", resp.Header.Get("Content-Encoding"), len(body))
+	}
+	if !compressible("text/css; charset=utf-8") || compressible("image/png") {
+		t.Error("text/* or a binary type is misclassified")
+	}
+}
+
+// TestSharedFileHandles stalls several downloads of one file and counts the
+// descriptors open on it.
+func TestSharedFileHandles(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd:", err)
+	}
+	dir := withDir(t)
+	file := filepath.Join(dir, "hot")
+	if err := os.WriteFile(file, make([]byte, 4<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		share bool
+		want  int
+	}{{false, 8}, {true, 1}} {
+		set(t, &shareFileHandles, tc.share)
+		var conns []net.Conn
+		for i := 0; i < 8; i++ {
+			c := dial(t)
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			go io.WriteString(c, request("GET", "/files/hot", nil))
+			if _, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil { // then leave the body unread
+				t.Fatal(err)
+			}
+			conns = append(conns, c)
+		}
+		if got := openDescriptors(file); got != tc.want {
+			t.Errorf("-share-file-handles=%v: %d descriptors open on the file, want %d", tc.share, got, tc.want)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+		for deadline := time.Now().Add(2 * time.Second); openDescriptors(file) > 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d descriptors still open once the downloads ended", openDescriptors(file))
+			}
+		}
+	}
+}
+
+// openDescriptors counts this process's descriptors open on file.
+func openDescriptors(file string) int {
+	fds, _ := os.ReadDir("/proc/self/fd")
+	n := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && target == file {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOptionsAcceptRanges(t *testing.T) {
+	withDir(t)
+	if resp, _ := do(t, request("OPTIONS", "/files/x", nil)); resp.StatusCode != 204 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("OPTIONS /files/x: got %d with Accept-Ranges %q, want bytes", resp.StatusCode, resp.Header.Get("Accept-Ranges"))
+	}
+	if resp, _ := do(t, request("OPTIONS", "/echo/x", nil)); resp.Header.Get("Accept-Ranges") != "" {
+		t.Errorf("OPTIONS /echo/x: Accept-Ranges %q, want none", resp.Header.Get("Accept-Ranges"))
+	}
+}
+
+func BenchmarkUploadBufferSize(b *testing.B) {
+	dir := b.TempDir()
+	data := make([]byte, 8<<20)
+	for _, size := range []int{minUploadBufferSize, 32 << 10, 1 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			old := uploadBufferSize
+			uploadBufferSize = size
+			defer func() { uploadBufferSize = old }()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				name, _, err := writeTemp(dir, struct{ io.Reader }{bytes.NewReader(data)}, nil) // hiding WriteTo, as a request body does
+				if err != nil {
+					b.Fatal(err)
+				}
+				os.Remove(name)
+			}
+		})
+	}
+}
+
+func TestContentAddressed(t *testing.T) {
+	dir := withDir(t)
+	set(t, &contentAddressed, true)
+	withRouter(t)
+	sum := sha256.Sum256([]byte("same content"))
+	want := "/files/" + hex.EncodeToString(sum[:])
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		resp, _ := do(t, request("POST", "/files", nil, "same content"))
+		if resp.Header.Get("Location") != want {
+			t.Errorf("upload %d: Location %q, want %q", i, resp.Header.Get("Location"), want)
+		}
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if statuses[0] != 201 || statuses[1] != 200 {
+		t.Errorf("statuses %v, want 201 then 200", statuses)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != hex.EncodeToString(sum[:]) {
+		t.Errorf("stored %v, want one file named by the hash", entries)
+	}
+	if _, body := do(t, request("GET", want, nil)); body != "same content" {
+		t.Errorf("GET %s: %q", want, body)
+	}
+}
+
+// TestDiskFull fails an upload's copy with ENOSPC, as a full disk would.
+func TestDiskFull(t *testing.T) {
+	dir := t.TempDir()
+	full := &os.PathError{Op: "write", Path: filepath.Join(dir, ".upload-1"), Err: syscall.ENOSPC}
+	_, _, err := writeTemp(dir, io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(full)), nil)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("got %v, want ENOSPC", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("partial upload left behind: %v", entries)
+	}
+	if got := statusCode(uploadFailed(err)); got != 507 {
+		t.Errorf("disk full: status %d, want 507", got)
+	}
+	if got := statusCode(uploadFailed(io.ErrUnexpectedEOF)); got != 400 {
+		t.Errorf("short body: status %d, want 400", got)
+	}
+}
+
+func TestPutWithoutDirectory(t *testing.T) {
+	var allows []string
+	for _, dir := range []string{"", t.TempDir()} {
+		set(t, &directory, dir)
+		withRouter(t)
+		resp, body := do(t, request("PUT", "/files/x", nil, "data"))
+		if resp.StatusCode != 405 || body != "" {
+			t.Errorf("-directory %q: got %d %q, want a 405", dir, resp.StatusCode, body)
+		}
+		allows = append(allows, resp.Header.Get("Allow"))
+	}
+	if allows[0] != allows[1] || allows[0] != "GET, HEAD, POST, OPTIONS" {
+		t.Errorf("Allow %q without -directory and %q with it, want GET, HEAD, POST, OPTIONS", allows[0], allows[1])
+	}
+}
+
+func TestBrotliSidecar(t *testing.T) {
+	dir := withDir(t)
+	set(t, &precompressed, true)
+	for name, data := range map[string]string{"app.js": "plain", "app.js.br": "brotli", "app.js.gz": "gzip"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct{ accept, encoding, body string }{
+		{"br", "br", "brotli"},
+		{"gzip, br", "br", "brotli"},
+		{"gzip, br;q=0.5", "gzip", "gzip"},
+		{"identity", "", "plain"},
+	} {
+		resp, body := do(t, request("GET", "/files/app.js", []string{"Accept-Encoding: " + tc.accept}))
+		if resp.Header.Get("Content-Encoding") != tc.encoding || body != tc.body {
+			t.Errorf("Accept-Encoding %q: got %q %q, want %q %q", tc.accept, resp.Header.Get("Content-Encoding"), body, tc.encoding, tc.body)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/javascript") {
+			t.Errorf("Accept-Encoding %q: Content-Type %q, want the original file's", tc.accept, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+// TestLargeDownloadStreams downloads 64 MiB and checks the server allocated a
+// small fraction of that, so the file went out as it was read.
+func TestLargeDownloadStreams(t *testing.T) {
+	dir := withDir(t)
+	const size = 64 << 20
+	data := bytes.Repeat([]byte{0, 0xff, 'x', 0x80}, size/4)
+	if err := os.WriteFile(filepath.Join(dir, "big"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	go io.WriteString(c, request("GET", "/files/big", nil))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != size {
+		t.Fatalf("Content-Length %d, want %d", resp.ContentLength, size)
+	}
+	h := sha256.New()
+	if n, err := io.Copy(h, resp.Body); err != nil || n != size {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	runtime.ReadMemStats(&after)
+	if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Error("the body differs from the file")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("allocated %d bytes for a %d-byte download", allocated, size)
+	}
+}
+
+func TestUploadFraming(t *testing.T) {
+	dir := withDir(t)
+	chunked := func(name string, chunks ...string) string {
+		var b strings.Builder
+		b.WriteString("POST /files/" + name + " HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n")
+		for _, c := range chunks {
+			b.WriteString(strconv.FormatInt(int64(len(c)), 16) + "\r\n" + c + "\r\n")
+		}
+		b.WriteString("0\r\n\r\n")
+		return b.String()
+	}
+	if resp, _ := do(t, chunked("c", "hello, ", "chunked ", "world")); resp.StatusCode != 201 {
+		t.Fatalf("chunked upload: status %d, want 201", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "c")); string(got) != "hello, chunked world" {
+		t.Errorf("file holds %q", got)
+	}
+
+	set(t, &maxBodySize, 10)
+	for name, raw := range map[string]string{
+		"sized":   request("POST", "/files/big1", nil, "01234567890"),
+		"chunked": chunked("big2", "012345", "67890"),
+	} {
+		if resp, _ := do(t, raw); resp.StatusCode != 413 {
+			t.Errorf("%s body over the limit: status %d, want 413", name, resp.StatusCode)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "big*")); len(matches) > 0 {
+		t.Errorf("oversized uploads were stored: %v", matches)
+	}
+}
+
+func TestUploadGzipBomb(t *testing.T) {
+	dir := withDir(t)
+	set(t, &maxBodySize, 1<<20)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(make([]byte, 4<<20))
+	zw.Close()
+	raw := fmt.Sprintf("POST /files/bomb HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\nConnection: close\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", gz.Len(), gz.Bytes())
+	if resp, _ := do(t, raw); resp.StatusCode != 413 {
+		t.Errorf("%d bytes of gzip decoding to 4 MB: status %d, want 413", gz.Len(), resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bomb")); !os.IsNotExist(err) {
+		t.Errorf("the decoded upload was stored: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+var sharedFiles = fileHandles{files: make(map[string]*sharedFile)}
+
+// fileHandles lets concurrent readers of one file share a single open
+// *os.File, which is safe because they only use ReadAt. It's used when
+// -share-file-handles is set, so a hot file costs one descriptor, not one per
+// request.
+type fileHandles struct {
+	mu    sync.Mutex
+	files map[string]*sharedFile
+}
+
+type sharedFile struct {
+	f    *os.File
+	refs int
+}
+
+// open returns a handle on file, opening it only if no other reader holds
+// one, and a release func to call once done reading.
+func (h *fileHandles) open(file string) (*os.File, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sf, ok := h.files[file]
+	if !ok {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		sf = &sharedFile{f: f}
+		h.files[file] = sf
+	}
+	sf.refs++
+	return sf.f, func() { h.release(file, sf) }, nil
+}
+
+func (h *fileHandles) release(file string, sf *sharedFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sf.refs--
+	if sf.refs == 0 {
+		sf.f.Close()
+		if h.files[file] == sf {
+			delete(h.files, file)
+		}
+	}
+}
+
+// forget stops handing out the current handle on file, which still refers to
+// the old content after the file is replaced. Readers holding it finish with
+// the old content, and the last of them closes it.
+func (h *fileHandles) forget(file string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.files, file)
+}
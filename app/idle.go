@@ -0,0 +1,90 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+var idle = newIdleConns()
+
+func init() {
+	metrics.register("http_idle_connections", func() int64 { return int64(idle.count()) })
+}
+
+// idleConns tracks connections waiting for their next request, least recently
+// used first, so the oldest can be closed when -max-idle-conns is reached.
+type idleConns struct {
+	mu     sync.Mutex
+	lru    *list.List
+	elems  map[net.Conn]*list.Element
+	closed bool // set by closeAll, after which idling isn't allowed
+}
+
+func newIdleConns() *idleConns {
+	return &idleConns{lru: list.New(), elems: make(map[net.Conn]*list.Element)}
+}
+
+// add marks con idle, first evicting the connection that has been idle the
+// longest if that would exceed the cap.
+func (ic *idleConns) add(con net.Conn) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.closed {
+		con.Close() // shutting down, its pending read fails at once
+		return
+	}
+	if maxIdleConns > 0 && ic.lru.Len() >= maxIdleConns {
+		ic.evictOldest("Too many idle connections, closing")
+	}
+	ic.elems[con] = ic.lru.PushBack(con)
+}
+
+// evict closes the connection that has been idle the longest, if any, so its
+// worker can take a connection waiting in the queue instead.
+func (ic *idleConns) evict() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.evictOldest("Every worker is busy, closing idle connection")
+}
+
+func (ic *idleConns) evictOldest(why string) {
+	oldest := ic.lru.Front()
+	if oldest == nil {
+		return
+	}
+	victim := ic.lru.Remove(oldest).(net.Conn)
+	delete(ic.elems, victim)
+	logInfo(why, victim.RemoteAddr())
+	victim.Close() // its pending read fails and the worker moves on
+}
+
+// remove marks con busy again. It's fine to call for a connection that was
+// already evicted.
+func (ic *idleConns) remove(con net.Conn) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if e, ok := ic.elems[con]; ok {
+		ic.lru.Remove(e)
+		delete(ic.elems, con)
+	}
+}
+
+func (ic *idleConns) count() int {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.lru.Len()
+}
+
+// closeAll closes every idle connection, and any that go idle from now on, so
+// shutdown only waits on connections with a request in progress.
+func (ic *idleConns) closeAll() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.closed = true
+	for con := range ic.elems {
+		con.Close()
+	}
+	ic.lru.Init()
+	clear(ic.elems)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepAlive opens a connection and has one request answered on it, leaving
+// it idle.
+func keepAlive(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, c)
+	return c
+}
+
+func roundTrip(t *testing.T, c net.Conn) {
+	t.Helper()
+	if _, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// waitIdle waits for n connections to be idle, since a connection goes idle
+// only after its response is out.
+func waitIdle(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); idle.count() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d idle connections, want %d", idle.count(), n)
+		}
+	}
+}
+
+// closed reports whether the server has closed c.
+func closed(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestIdleCapEvictsLeastRecentlyUsed(t *testing.T) {
+	set(t, &maxIdleConns, 2)
+	addr := serve(t)
+	first := keepAlive(t, addr)
+	waitIdle(t, 1)
+	second := keepAlive(t, addr)
+	waitIdle(t, 2)
+	roundTrip(t, first) // first is now the most recently used
+	waitIdle(t, 2)
+	keepAlive(t, addr)
+	waitIdle(t, 2)
+	if !closed(second) {
+		t.Error("least recently used connection is still open")
+	}
+	if closed(first) {
+		t.Error("most recently used connection was closed")
+	}
+	if got := metrics.render(); !strings.Contains(got, "http_idle_connections 2\n") {
+		t.Errorf("metrics are %q, want 2 idle connections", got)
+	}
+}
+
+// TestSaturatedPoolEvictsIdle fills every worker with an idle connection,
+// under the cap, then connects again: the new connection is served at once,
+// through the worker of the least recently used one.
+func TestSaturatedPoolEvictsIdle(t *testing.T) {
+	set(t, &maxIdleConns, 10)
+	set(t, &workers, 2)
+	addr := serve(t)
+	first := keepAlive(t, addr)
+	waitIdle(t, 1)
+	second := keepAlive(t, addr)
+	waitIdle(t, 2)
+	keepAlive(t, addr) // times out unless a worker is freed
+	if !closed(first) {
+		t.Error("least recently used connection is still open")
+	}
+	roundTrip(t, second)
+}
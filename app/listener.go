@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server accepts connections on a set of addresses and hands them to a
+// shared worker pool.
+type Server struct {
+	// OnConnect and OnDisconnect, if set, are called with the client's
+	// address when a worker picks up a connection and once it's closed, for
+	// instrumentation. They run on the worker, so they should be quick.
+	OnConnect    func(remoteAddr string)
+	OnDisconnect func(remoteAddr string)
+
+	// TLSAddrs are further addresses to accept connections on, which are
+	// served over TLS. If there are none, every address is when tlsConfig is
+	// set, so plain HTTP and HTTPS can share a server only by listing both.
+	TLSAddrs []string
+
+	addrs     []string
+	ready     chan struct{}
+	listeners []listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{} // accepted and not yet closed
+	wg      sync.WaitGroup        // one per entry in conns
+	busy    atomic.Int64          // connections a worker is serving
+	drained chan struct{}         // closed once Shutdown is done with conns
+}
+
+// listener is a bound address, and whether its connections speak TLS.
+type listener struct {
+	net.Listener
+	secure bool
+}
+
+// draining is set once shutdown begins, so every response still being
+// written closes its connection instead of keeping it alive.
+var draining atomic.Bool
+
+// NewServer returns a Server for addrs, each host:port or unix:/path.
+func NewServer(addrs []string) *Server {
+	return &Server{addrs: addrs, ready: make(chan struct{}), conns: make(map[net.Conn]struct{}), drained: make(chan struct{})}
+}
+
+// Ready is closed once every listener is bound and accepting, so callers can
+// connect without racing startup.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// ListenAndServe binds every address, then accepts connections until Shutdown
+// is called, returning once that has drained them. It returns early if an
+// address can't be bound.
+func (s *Server) ListenAndServe() error {
+	secureAll := tlsConfig.Load() != nil && len(s.TLSAddrs) == 0
+	for i, addr := range append(s.addrs, s.TLSAddrs...) {
+		network, address := "tcp", withDefaultPort(addr)
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, address = "unix", path
+		}
+		l, err := net.Listen(network, address) // listening on the port
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to bind to %s: %w", addr, err)
+		}
+		secure := secureAll || i >= len(s.addrs)
+		if secure {
+			logInfo("Listening on", addr, "(TLS)")
+		} else {
+			logInfo("Listening on", addr)
+		}
+		s.listeners = append(s.listeners, listener{l, secure})
+	}
+	defer s.closeListeners()
+
+	queue := startWorkers(workers, queueSize, s.serveConn)
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(l, queue) // every listener feeds the same worker pool
+		}()
+	}
+	close(s.ready) // the listeners already queue connections, so it's safe to dial now
+	logInfo("Ready")
+	wg.Wait()
+	<-s.drained
+	return nil
+}
+
+// Shutdown stops accepting connections and closes the idle ones at once.
+// Connections with a request in progress, such as a long download or an
+// event stream, get up to drain to finish it, then are cut off.
+func (s *Server) Shutdown(drain time.Duration) {
+	s.mu.Lock()
+	draining.Store(true) // under mu, so no connection is tracked once wg is being waited on
+	s.mu.Unlock()
+	s.closeListeners()
+	idle.closeAll()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	s.mu.Lock()
+	logInfo("Shutting down, draining", len(s.conns), "connections")
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(drain):
+		s.mu.Lock()
+		logWarn("Drain timeout, closing", len(s.conns), "connections")
+		for con := range s.conns {
+			con.Close() // the handler's next read or write fails
+		}
+		s.mu.Unlock()
+		<-done
+	}
+	close(s.drained)
+}
+
+// track counts con among the connections Shutdown waits for, or reports false
+// if shutdown has begun, when it's too late to join them.
+func (s *Server) track(con net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if draining.Load() {
+		return false
+	}
+	s.conns[con] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(con net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, con)
+	s.wg.Done()
+}
+
+// serveConn handles con between the lifecycle hooks.
+func (s *Server) serveConn(con net.Conn) {
+	defer s.untrack(con)
+	s.busy.Add(1)
+	defer s.busy.Add(-1)
+	addr := con.RemoteAddr().String()
+	if s.OnConnect != nil {
+		s.OnConnect(addr)
+	}
+	if s.OnDisconnect != nil {
+		defer s.OnDisconnect(addr)
+	}
+	handle(con)
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// withDefaultPort adds port 4221 to a bare host such as "::1" or "localhost",
+// bracketing IPv6 literals as needed.
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "4221")
+}
+
+func (s *Server) acceptLoop(l listener, queue chan<- net.Conn) {
+	for { // typically web servers are implemented as infinitely running for-loops!
+		con, err := l.Accept() // when the client connects, accept the connection - this is a blocking call
+		if err != nil {
+			if draining.Load() {
+				return // Shutdown closed the listener
+			}
+			logError("Error accepting connection: ", err.Error())
+			os.Exit(1)
+		}
+		logDebug("Connection accepted...")
+		if l.secure {
+			con = tls.Server(con, tlsConfig.Load()) // looked up per connection, so a reload applies without rebinding
+		}
+		if !s.track(con) {
+			con.Close() // accepted just as Shutdown closed the listener
+			return
+		}
+		select {
+		case queue <- con:
+			if maxIdleConns > 0 && s.busy.Load() >= int64(workers) {
+				// Rather than have con wait out some idle connection's
+				// timeout, free up that connection's worker now.
+				idle.evict()
+			}
+		default:
+			go func() {
+				defer s.untrack(con)
+				reject(con) // every worker is busy and the queue is full
+			}()
+		}
+	}
+}
+
+// startWorkers runs a fixed pool of goroutines handling connections off the
+// returned queue, which caps concurrency no matter how many clients connect.
+func startWorkers(n int, size int, serve func(net.Conn)) chan<- net.Conn {
+	queue := make(chan net.Conn, size)
+	for i := 0; i < n; i++ {
+		go func() {
+			for con := range queue {
+				serve(con)
+			}
+		}()
+	}
+	return queue
+}
+
+func reject(con net.Conn) {
+	defer con.Close()
+	logWarn("Server busy, rejecting connection from", con.RemoteAddr())
+	headers := map[string]string{"Connection": "close"}
+	if err := writeAll(con, []byte(createResponse("503 Service Unavailable", headers, ""))); err != nil {
+		logDebug("Error writing: ", err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startDownload begins a GET of a 16 MiB file and reads just its head, so the
+// rest of the body is still being sent.
+func startDownload(t *testing.T, s *Server) *http.Response {
+	t.Helper()
+	dir := withDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "big"), make([]byte, 16<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, "GET /files/big HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestShutdownLetsDownloadFinish(t *testing.T) {
+	s := startServer(t)
+	idleConn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleConn.Close()
+	resp := startDownload(t, s)
+
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown(5 * time.Second)
+		close(done)
+	}()
+	idleConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idleConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection: read %v, want it closed at once", err)
+	}
+	time.Sleep(100 * time.Millisecond) // so the download is still going once draining has begun
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != 16<<20 {
+		t.Errorf("download read %d of %d bytes: %v", n, 16<<20, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Shutdown didn't return once the download finished")
+	}
+}
+
+func TestShutdownCutsOffAfterDrain(t *testing.T) {
+	s := startServer(t)
+	resp := startDownload(t, s)
+	start := time.Now()
+	s.Shutdown(100 * time.Millisecond) // the client isn't reading, so it can't finish in time
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Shutdown took %s with a drain of 100ms", took)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err == nil || n == 16<<20 {
+		t.Errorf("download read %d bytes with error %v, want it cut short", n, err)
+	}
+}
+
+// TestShutdownRefusesLateConnections connects while Shutdown is running, which
+// mustn't add to what it waits for: a WaitGroup.Add racing its Wait panics or
+// shows up under -race.
+func TestShutdownRefusesLateConnections(t *testing.T) {
+	s := startServer(t)
+	addr := s.listeners[0].Addr().String()
+	stop := make(chan struct{})
+	dialed := make(chan struct{})
+	go func() {
+		defer close(dialed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Shutdown(time.Second)
+	close(stop)
+	<-dialed
+}
+
+func TestWorkersBoundConcurrency(t *testing.T) {
+	const n = 3
+	var running, most atomic.Int64
+	var wg sync.WaitGroup
+	queue := startWorkers(n, 20, func(net.Conn) {
+		defer wg.Done()
+		now := running.Add(1)
+		for m := most.Load(); now > m && !most.CompareAndSwap(m, now); m = most.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+	})
+	wg.Add(20)
+	for i := 0; i < 20; i++ {
+		queue <- nil
+	}
+	wg.Wait()
+	close(queue)
+	if most.Load() != n {
+		t.Errorf("%d connections were handled at once, want %d", most.Load(), n)
+	}
+}
+
+func TestListenOnTwoAddresses(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	s := startServer(t, "127.0.0.1:0", "unix:"+sock)
+	if len(s.listeners) != 2 {
+		t.Fatalf("%d listeners, want 2", len(s.listeners))
+	}
+	for _, l := range s.listeners {
+		addr := l.Addr()
+		c, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		roundTrip(t, c)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	for addr, want := range map[string]string{"::1": "[::1]:4221", "[::1]": "[::1]:4221", "[::1]:80": "[::1]:80", "localhost": "localhost:4221"} {
+		if got := withDefaultPort(addr); got != want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", addr, got, want)
+		}
+	}
+	if got := clientIP(&Request{RemoteAddr: "[::1]:4221"}); got != "::1" {
+		t.Errorf("clientIP of [::1]:4221 = %q, want ::1", got)
+	}
+
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		l.Close()
+	}
+	s := startServer(t, "[::1]:0")
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, c)
+}
+
+func TestReady(t *testing.T) {
+	select {
+	case <-NewServer([]string{"127.0.0.1:0"}).Ready():
+		t.Fatal("Ready before ListenAndServe")
+	default:
+	}
+	s := startServer(t) // returns once Ready is closed
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, c)
+}
+
+func TestConnectionHooks(t *testing.T) {
+	s := NewServer(nil)
+	events := make(chan string, 2)
+	s.OnConnect = func(addr string) { events <- "connect " + addr }
+	s.OnDisconnect = func(addr string) { events <- "disconnect " + addr }
+	client, server := net.Pipe()
+	defer client.Close()
+	s.track(server)
+	go s.serveConn(server)
+	go io.WriteString(client, request("GET", "/", nil))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"connect pipe", "disconnect pipe"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %q", want)
+		}
+	}
+}
+
+// TestShutdownClosesListenerCleanly shuts down with every accept loop blocked
+// in Accept. Were the resulting error fatal, the test binary would exit.
+func TestShutdownClosesListenerCleanly(t *testing.T) {
+	logs := captureLog(t, levelError)
+	s := startServer(t, "127.0.0.1:0", "127.0.0.1:0")
+	addr := s.listeners[0].Addr().String()
+	s.Shutdown(time.Second)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("still accepting after Shutdown")
+	}
+	if logs.String() != "" {
+		t.Errorf("logged %q", logs)
+	}
+}
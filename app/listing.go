@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// listEntry is one entry of a JSON directory listing.
+type listEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Type string `json:"type"` // "file" or "dir"
+}
+
+// listDirectory answers a request for a directory under /files with its
+// entries, as JSON if the client accepts it and HTML otherwise, unless
+// -dir-listing picks JSON as the default.
+func listDirectory(dir string, req *Request) string {
+	dirEntries, err := os.ReadDir(dir) // sorted by name
+	if err != nil {
+		logError("Error listing directory: ", dir, err)
+		return createResponse("500 Internal Server Error", nil, "")
+	}
+	entries := make([]listEntry, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		entry := listEntry{Name: de.Name(), Size: info.Size(), Type: "file"}
+		if de.IsDir() {
+			entry.Size, entry.Type = 0, "dir"
+		}
+		entries = append(entries, entry)
+	}
+
+	if dirListing == "json" || acceptsJSON(req.Headers["accept"]) {
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return createResponse("500 Internal Server Error", nil, "")
+		}
+		w := listingResponse("application/json", req)
+		w.Write(data)
+		return w.close()
+	}
+	base := strings.TrimSuffix(req.Path, "/") + "/"
+	w := listingResponse("text/html; charset=utf-8", req)
+	w.WriteString("<!DOCTYPE html>\n<title>Index of " + html.EscapeString(base) + "</title>\n<ul>\n")
+	for _, e := range entries {
+		name := e.Name
+		if e.Type == "dir" {
+			name += "/"
+		}
+		href := (&url.URL{Path: base + name}).EscapedPath()
+		w.WriteString(`<li><a href="` + html.EscapeString(href) + `">` + html.EscapeString(name) + "</a></li>\n")
+	}
+	w.WriteString("</ul>\n")
+	return w.close()
+}
+
+func listingResponse(contentType string, req *Request) *responseBuffer {
+	w := newResponseBuffer("200 OK", contentType)
+	w.headers["Vary"] = "Accept"
+	w.acceptEncoding = acceptEncoding(req.Headers)
+	return w
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONListing(t *testing.T) {
+	dir := withDir(t)
+	set(t, &dirListing, "html")
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("12345"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := do(t, request("GET", "/files/", []string{"Accept: text/html;q=0.5, application/json"}))
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q, want a JSON listing", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var entries []listEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []listEntry{{"a.txt", 5, "file"}, {"sub", 0, "dir"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+	if resp, body := do(t, request("GET", "/files/", nil)); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, `href="/files/sub/"`) {
+		t.Errorf("without Accept: got %q %q, want the HTML listing", resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestListingAndRevalidation(t *testing.T) {
+	dir := withDir(t)
+	set(t, &dirListing, "html")
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"sub/a <b>.css": "p{}", "sub/page.html": "<p>"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, body := do(t, request("GET", "/files/sub/", nil))
+	if resp.StatusCode != 200 || !strings.Contains(body, `<a href="/files/sub/a%20%3Cb%3E.css">a &lt;b&gt;.css</a>`) || !strings.Contains(body, `href="/files/sub/page.html"`) {
+		t.Errorf("listing: got %d %q", resp.StatusCode, body)
+	}
+
+	for name, want := range map[string]string{"a%20%3Cb%3E.css": "text/css; charset=utf-8", "page.html": "text/html; charset=utf-8"} {
+		resp, _ := do(t, request("GET", "/files/sub/"+name, nil))
+		if resp.Header.Get("Content-Type") != want {
+			t.Errorf("%s: Content-Type %q, want %q", name, resp.Header.Get("Content-Type"), want)
+		}
+		for _, validator := range []string{"If-None-Match: " + resp.Header.Get("ETag"), "If-Modified-Since: " + resp.Header.Get("Last-Modified")} {
+			if again, _ := do(t, request("GET", "/files/sub/"+name, []string{validator})); again.StatusCode != 304 {
+				t.Errorf("%s with %q: status %d, want 304", name, validator, again.StatusCode)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log levels, in increasing severity. Messages below -log-level are dropped.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevel is parsed from -log-level at startup.
+var logLevel = levelInfo
+
+// logOutput and accessOutput are where leveled messages and the access log
+// go, stderr and stdout outside of tests.
+var (
+	logOutput    io.Writer = os.Stderr
+	accessOutput io.Writer = os.Stdout
+)
+
+func parseLogLevel(s string) (int, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// logAt writes a to logOutput the way fmt.Println would, prefixed with the time
+// and level, if level is at or above -log-level. Stdout is left to the
+// access log.
+func logAt(level int, a ...any) {
+	if level < logLevel {
+		return
+	}
+	prefix := []any{time.Now().Format(time.RFC3339), strings.ToUpper(levelNames[level])}
+	fmt.Fprintln(logOutput, append(prefix, a...)...)
+}
+
+func logDebug(a ...any) { logAt(levelDebug, a...) }
+func logInfo(a ...any)  { logAt(levelInfo, a...) }
+func logWarn(a ...any)  { logAt(levelWarn, a...) }
+func logError(a ...any) { logAt(levelError, a...) }
+
+// accessEntry is one line of the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Target   string    `json:"target"`
+	Version  string    `json:"version"`
+	Status   int       `json:"status"` // 0 if no response was sent
+	Bytes    int64     `json:"bytes"`  // of body, not counting the head
+	Duration float64   `json:"duration_ms"`
+	ID       string    `json:"id,omitempty"`
+}
+
+// logAccess writes e to accessOutput in the -access-log format: "common" is the
+// Common Log Format with the duration in milliseconds appended, "json" one
+// object per line.
+func logAccess(e accessEntry) {
+	switch accessLog {
+	case "common":
+		status, bytes := "-", "-"
+		if e.Status != 0 {
+			status, bytes = fmt.Sprint(e.Status), fmt.Sprint(e.Bytes)
+		}
+		line := "-"
+		if e.Method != "" {
+			line = e.Method + " " + e.Target + " " + e.Version
+		}
+		fmt.Fprintf(accessOutput, "%s - - [%s] %q %s %s %.3f\n", e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"), line, status, bytes, e.Duration)
+	case "json":
+		data, _ := json.Marshal(e)
+		fmt.Fprintln(accessOutput, string(data))
+	}
+}
+
+// statusCode reads the status code off a serialized response, or 0.
+func statusCode(response string) int {
+	if len(response) < 12 {
+		return 0
+	}
+	var code int
+	fmt.Sscanf(response[9:12], "%d", &code)
+	return code
+}
+
+// bodySize is the length of a serialized response's body.
+func bodySize(response string) int64 {
+	_, body, _ := strings.Cut(response, "\r\n\r\n")
+	return int64(len(body))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// captureAccessLog sends the access log, as JSON, to the returned buffer until
+// the test ends.
+func captureAccessLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	set(t, &accessLog, "json")
+	set(t, &accessOutput, io.Writer(buf))
+	return buf
+}
+
+func accessEntries(t *testing.T, log string) []accessEntry {
+	t.Helper()
+	var entries []accessEntry
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		var e accessEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("access log line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	for _, tc := range []struct {
+		raw    string
+		status int
+		bytes  int64
+	}{
+		{request("GET", "/echo/hello", nil), 200, 5},
+		{request("GET", "/missing", nil), 404, 0},
+		{request("GET", "/drip?bytes=3&duration=0", nil), 200, int64(len("1\r\n*\r\n")*3 + len("0\r\n\r\n"))}, // written by the handler
+		{"G(T / HTTP/1.1\r\nHost: localhost\r\n\r\n", 400, 0},                                                 // never parsed
+	} {
+		log := captureAccessLog(t)
+		resp, _ := do(t, tc.raw)
+		entries := accessEntries(t, log.String())
+		if len(entries) != 1 {
+			t.Fatalf("%q: %d access log entries, want 1", tc.raw, len(entries))
+		}
+		e := entries[0]
+		if e.Status != tc.status || e.Bytes != tc.bytes {
+			t.Errorf("%q: logged status %d with %d bytes, want %d with %d", tc.raw, e.Status, e.Bytes, tc.status, tc.bytes)
+		}
+		if e.Remote != "pipe" { // net.Pipe's address, however the request ended
+			t.Errorf("%q: logged remote %q, want pipe", tc.raw, e.Remote)
+		}
+		if e.ID == "" || e.ID != resp.Header.Get("X-Request-Id") {
+			t.Errorf("%q: logged ID %q, but the response's is %q", tc.raw, e.ID, resp.Header.Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	buf := &syncBuffer{}
+	set(t, &accessLog, "common")
+	set(t, &accessOutput, io.Writer(buf))
+	do(t, request("GET", "/echo/hi", nil))
+	if got := buf.String(); !strings.HasPrefix(got, "pipe - - [") || !strings.Contains(got, `] "GET /echo/hi HTTP/1.1" 200 2 `) {
+		t.Errorf("access log is %q", got)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]int{"debug": levelDebug, "INFO": levelInfo, "Warn": levelWarn, "error": levelError} {
+		if got, err := parseLogLevel(name); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel(\"verbose\") succeeded")
+	}
+	log := captureLog(t, levelWarn)
+	logInfo("dropped")
+	logWarn("kept")
+	if got := log.String(); strings.Contains(got, "dropped") || !strings.Contains(got, "WARN kept") {
+		t.Errorf("log is %q, want only the warning", got)
+	}
+}
+
+func TestAccessLogVersion(t *testing.T) {
+	for _, version := range []string{"HTTP/1.0", "HTTP/1.1"} {
+		log := captureAccessLog(t)
+		do(t, "GET /echo/x "+version+"\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		if entries := accessEntries(t, log.String()); len(entries) != 1 || entries[0].Version != version {
+			t.Errorf("logged %+v, want version %s", entries, version)
+		}
+	}
+	log := &syncBuffer{}
+	set(t, &accessLog, "common")
+	set(t, &accessOutput, io.Writer(log))
+	do(t, "GET /echo/x HTTP/1.0\r\n\r\n")
+	if !strings.Contains(log.String(), `"GET /echo/x HTTP/1.0" 200 1 `) {
+		t.Errorf("common log line %q lacks the version", log)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	defineFlags(flag.NewFlagSet("http-server", flag.ContinueOnError))
+	logOutput, accessOutput = io.Discard, io.Discard
+	router = newRouter()
+	os.Exit(m.Run())
+}
+
+// set assigns v to *p until the test ends. Flags are package variables, so
+// tests that change them don't run in parallel.
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// captureLog sends everything logged at level or above to the returned
+// buffer until the test ends.
+func captureLog(t *testing.T, level int) *syncBuffer {
+	buf := &syncBuffer{}
+	set(t, &logOutput, io.Writer(buf))
+	set(t, &logLevel, level)
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer that handlers can write to while a test reads.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// withRouter rebuilds the router, for tests whose flags change which routes
+// exist. Call it after the flags are set.
+func withRouter(t *testing.T) {
+	old := router
+	router = newRouter()
+	t.Cleanup(func() { router = old })
+}
+
+// withDir makes -directory a fresh temporary directory and returns it.
+func withDir(t *testing.T) string {
+	dir := t.TempDir()
+	set(t, &directory, dir)
+	return dir
+}
+
+// serve runs a Server on a loopback port and returns its address.
+func serve(t *testing.T) string {
+	t.Helper()
+	return startServer(t).listeners[0].Addr().String()
+}
+
+// startServer runs a Server on addrs, by default a loopback port. It's shut
+// down, unless the test already did, and the shutdown state reset when the
+// test ends.
+func startServer(t *testing.T, addrs ...string) *Server {
+	t.Helper()
+	if len(addrs) == 0 {
+		addrs = []string{"127.0.0.1:0"}
+	}
+	return run(t, NewServer(addrs))
+}
+
+// run is startServer for a Server the test has set up itself.
+func run(t *testing.T, s *Server) *Server {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe() }()
+	select {
+	case <-s.Ready():
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-s.drained:
+		default:
+			s.Shutdown(time.Second)
+		}
+		<-errc
+		draining.Store(false)
+		idle.mu.Lock()
+		idle.closed = false
+		idle.mu.Unlock()
+	})
+	return s
+}
+
+// dial serves a connection over net.Pipe and returns the client's end. The
+// server's end is closed, and its handler waited for, when the test ends.
+func dial(t *testing.T) net.Conn {
+	t.Helper()
+	c, _ := pipe(t)
+	return c
+}
+
+// pipe is dial, also returning a channel closed once the handler returns.
+func pipe(t *testing.T) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handle(server)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client, done
+}
+
+// exchange writes raw to a fresh connection and returns everything the server
+// sends back before closing it, so raw's last request should end the
+// connection, e.g. with request's Connection: close. The handler has returned
+// by then, so the test can change flags again.
+func exchange(t *testing.T, raw string) string {
+	t.Helper()
+	c, done := pipe(t)
+	go c.Write([]byte(raw)) // a pipe write blocks until the server has read it all
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("reading the response to %q: %v (got %q)", raw, err, out)
+	}
+	<-done
+	return string(out)
+}
+
+// do sends raw and parses the one response to it, returning its body too.
+func do(t *testing.T, raw string) (*http.Response, string) {
+	t.Helper()
+	resps := parseResponses(t, exchange(t, raw), methodOf(raw))
+	if len(resps) != 1 {
+		t.Fatalf("got %d responses to %q, want 1", len(resps), raw)
+	}
+	return resps[0].Response, resps[0].body
+}
+
+type response struct {
+	*http.Response
+	body string
+}
+
+// parseResponses splits out, the bytes sent on a connection, into responses.
+// method is that of every request, which matters only for HEAD.
+func parseResponses(t *testing.T, out string, method string) []response {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(out))
+	var resps []response
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return resps
+		}
+		resp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("parsing response %d of %q: %v", len(resps)+1, out, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body %d of %q: %v", len(resps)+1, out, err)
+		}
+		resps = append(resps, response{resp, string(body)})
+	}
+}
+
+func methodOf(raw string) string {
+	method, _, _ := strings.Cut(raw, " ")
+	return method
+}
+
+// request serializes an HTTP/1.1 request that closes the connection after
+// it, adding a Host header. Each header is a "Name: value" line, and body, if
+// given, is sent with its Content-Length.
+func request(method, target string, headers []string, body ...string) string {
+	var b strings.Builder
+	b.WriteString(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n")
+	for _, h := range headers {
+		b.WriteString(h + "\r\n")
+	}
+	content := strings.Join(body, "")
+	if len(body) > 0 {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(content)) + "\r\n")
+	}
+	b.WriteString("Connection: close\r\n\r\n" + content)
+	return b.String()
+}
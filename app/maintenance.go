@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// inMaintenance is set while every route but /health answers 503.
+var inMaintenance atomic.Bool
+
+// loadMaintenance works out whether the server is in maintenance mode: it is
+// if -maintenance is set or -maintenance-file exists. It runs at startup and
+// again on SIGHUP, so creating or removing the file toggles the mode.
+func loadMaintenance() {
+	on := maintenance
+	if maintenanceFile != "" {
+		if _, err := os.Stat(maintenanceFile); err == nil {
+			on = true
+		}
+	}
+	if inMaintenance.Swap(on) != on {
+		logInfo("Maintenance mode:", on)
+	}
+}
+
+func maintenanceResponse() string {
+	headers := map[string]string{"Content-Type": "text/plain"}
+	return createResponse("503 Service Unavailable", headers, maintenanceMessage) // Retry-After comes from -retry-after
+}
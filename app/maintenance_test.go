@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	t.Cleanup(func() { inMaintenance.Store(false) })
+	set(t, &maintenanceMessage, "back soon")
+	check := func(on bool) {
+		t.Helper()
+		resp, body := do(t, request("GET", "/echo/x", nil))
+		if on && (resp.StatusCode != 503 || body != "back soon" || resp.Header.Get("Retry-After") != "1") {
+			t.Errorf("in maintenance: got %d %q with Retry-After %q", resp.StatusCode, body, resp.Header.Get("Retry-After"))
+		}
+		if !on && resp.StatusCode != 200 {
+			t.Errorf("out of maintenance: status %d", resp.StatusCode)
+		}
+		if resp, _ := do(t, request("GET", "/health", nil)); resp.StatusCode != 200 {
+			t.Errorf("/health: status %d, want 200", resp.StatusCode)
+		}
+	}
+	set(t, &maintenance, true)
+	loadMaintenance()
+	check(true)
+
+	set(t, &maintenance, false)
+	file := filepath.Join(t.TempDir(), "maintenance")
+	set(t, &maintenanceFile, file)
+	loadMaintenance() // as on SIGHUP
+	check(false)
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loadMaintenance()
+	check(true)
+	os.Remove(file)
+	loadMaintenance()
+	check(false)
+}
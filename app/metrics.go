@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var metrics = registry{values: make(map[string]func() int64)}
+
+// registry collects named values, each read through a callback when /metrics
+// is scraped so nothing has to push updates into it.
+type registry struct {
+	mu     sync.Mutex
+	values map[string]func() int64
+}
+
+func (r *registry) register(name string, value func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[name] = value
+}
+
+// render formats every value in the Prometheus text format, sorted by name.
+func (r *registry) render() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.values))
+	for name := range r.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %d\n", name, r.values[name]())
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// forwardedElement is the first (client-most) element of a Forwarded header,
+// with the for= node reduced to a bare address.
+type forwardedElement struct {
+	forAddr string
+	proto   string
+}
+
+// parseForwarded reads the RFC 7239 Forwarded header. Each proxy appends an
+// element, so only the first one describes the original client.
+func parseForwarded(header string) forwardedElement {
+	var fe forwardedElement
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "for":
+			fe.forAddr = stripPort(v)
+		case "proto":
+			fe.proto = strings.ToLower(v)
+		}
+	}
+	return fe
+}
+
+// stripPort drops an optional port from an address, unwrapping a bracketed
+// IPv6 literal.
+func stripPort(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end > 0 {
+			return addr[1:end]
+		}
+		return addr
+	}
+	if strings.Count(addr, ":") == 1 { // host:port, a bare IPv6 address has several colons
+		addr, _, _ = strings.Cut(addr, ":")
+	}
+	return addr
+}
+
+// clientIP is the address of the peer, or with -trust-proxy, the client the
+// proxy says it's forwarding for: Forwarded first, then X-Forwarded-For.
+func clientIP(req *Request) string {
+	if trustProxy {
+		if fe := parseForwarded(req.Headers["forwarded"]); fe.forAddr != "" && fe.forAddr != "unknown" {
+			return fe.forAddr
+		}
+		if xff := req.Headers["x-forwarded-for"]; xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return stripPort(strings.TrimSpace(first))
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// requestScheme is "http" unless a trusted proxy reports the client used
+// something else.
+func requestScheme(req *Request) string {
+	if trustProxy {
+		if fe := parseForwarded(req.Headers["forwarded"]); fe.proto != "" {
+			return fe.proto
+		}
+		if proto := req.Headers["x-forwarded-proto"]; proto != "" {
+			return strings.ToLower(strings.TrimSpace(proto))
+		}
+	}
+	if req.conn != nil && overTLS(req.conn) {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestForwarded(t *testing.T) {
+	req := &Request{RemoteAddr: "10.0.0.1:5555", Headers: map[string]string{
+		"forwarded":       `for="[2001:db8::1]:4711";proto=HTTPS;host=example.com, for=10.0.0.2`,
+		"x-forwarded-for": "192.0.2.9",
+	}}
+	if ip, scheme := clientIP(req), requestScheme(req); ip != "10.0.0.1" || scheme != "http" {
+		t.Errorf("untrusted: got %s %s, want the peer", ip, scheme)
+	}
+	set(t, &trustProxy, true)
+	if ip, scheme := clientIP(req), requestScheme(req); ip != "2001:db8::1" || scheme != "https" {
+		t.Errorf("Forwarded: got %s %s, want 2001:db8::1 https", ip, scheme)
+	}
+	delete(req.Headers, "forwarded")
+	if ip := clientIP(req); ip != "192.0.2.9" {
+		t.Errorf("X-Forwarded-For: got %s, want 192.0.2.9", ip)
+	}
+	req.Headers["forwarded"] = "for=unknown"
+	if ip := clientIP(req); ip != "192.0.2.9" {
+		t.Errorf("Forwarded for=unknown: got %s, want the X-Forwarded-For address", ip)
+	}
+}
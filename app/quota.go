@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errQuotaExceeded is returned mid-upload by a body limited by withQuota.
+var errQuotaExceeded = errors.New("upload quota exceeded")
+
+var uploadQuotas = quotaTracker{usage: make(map[string]*quotaUsage)}
+
+// quotaTracker counts the bytes each client has uploaded in the current
+// -upload-quota-window, which starts with its first upload.
+type quotaTracker struct {
+	mu        sync.Mutex
+	usage     map[string]*quotaUsage
+	lastPrune time.Time
+}
+
+type quotaUsage struct {
+	bytes int64
+	start time.Time
+}
+
+// remaining reports how many more bytes client may upload in its window.
+func (q *quotaTracker) remaining(client string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return uploadQuota - q.current(client, time.Now()).bytes
+}
+
+// charge counts n more bytes against client, reporting whether they still fit
+// the quota. Bytes that don't fit are counted anyway; they were read.
+func (q *quotaTracker) charge(client string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(client, time.Now())
+	u.bytes += n
+	return u.bytes <= uploadQuota
+}
+
+// current returns client's usage, starting a new window if the last one is
+// over. It also forgets every expired window, at most once per window, so
+// clients that have stopped uploading don't stay in the map. q.mu must be held.
+func (q *quotaTracker) current(client string, now time.Time) *quotaUsage {
+	if now.Sub(q.lastPrune) > uploadQuotaWindow {
+		for c, u := range q.usage {
+			if now.Sub(u.start) > uploadQuotaWindow {
+				delete(q.usage, c)
+			}
+		}
+		q.lastPrune = now
+	}
+	u, ok := q.usage[client]
+	if !ok || now.Sub(u.start) > uploadQuotaWindow {
+		u = &quotaUsage{start: now}
+		q.usage[client] = u
+	}
+	return u
+}
+
+// withQuota limits an upload of req's body to what's left of the client's
+// quota. It reports false, without reading anything, if a declared
+// Content-Length already doesn't fit.
+func withQuota(req *Request) (io.Reader, bool) {
+	if uploadQuota <= 0 {
+		return req.Body, true
+	}
+	client := clientIP(req)
+	if req.ContentLength > uploadQuotas.remaining(client) {
+		return nil, false
+	}
+	return &quotaReader{r: req.Body, client: client}, true
+}
+
+type quotaReader struct {
+	r      io.Reader
+	client string
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	if n > 0 && !uploadQuotas.charge(qr.client, int64(n)) {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
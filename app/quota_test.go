@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUploadQuota(t *testing.T) {
+	withDir(t)
+	set(t, &uploadQuota, 10)
+	set(t, &uploadQuotaWindow, time.Hour) // long enough that the uploads share a window, however slowly they run
+	forgetQuotas(t)
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{{"123456", 201}, {"123456", 413}, {"1234", 201}, {"1", 413}} {
+		if resp, _ := do(t, request("POST", "/files/q", nil, tc.body)); resp.StatusCode != tc.status {
+			t.Errorf("uploading %d bytes: status %d, want %d", len(tc.body), resp.StatusCode, tc.status)
+		}
+	}
+	uploadQuotas.mu.Lock()
+	for _, u := range uploadQuotas.usage {
+		u.start = u.start.Add(-2 * time.Hour) // the window ends
+	}
+	uploadQuotas.mu.Unlock()
+	if resp, _ := do(t, request("POST", "/files/q", nil, "123456")); resp.StatusCode != 201 {
+		t.Errorf("in a new window: status %d, want 201", resp.StatusCode)
+	}
+}
+
+// TestQuotaRefusesBeforeBody declares an upload over the quota and reads the
+// 413 without sending any of it, so the connection has to close.
+func TestQuotaRefusesBeforeBody(t *testing.T) {
+	withDir(t)
+	set(t, &uploadQuota, 10)
+	forgetQuotas(t)
+	c, done := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, "POST /files/q HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 413 || !resp.Close {
+		t.Errorf("got status %d, close %v; want a 413 that closes the connection", resp.StatusCode, resp.Close)
+	}
+	<-done
+}
+
+// forgetQuotas clears every client's -upload-quota usage when the test ends.
+func forgetQuotas(t *testing.T) {
+	t.Cleanup(func() {
+		uploadQuotas.mu.Lock()
+		uploadQuotas.usage = make(map[string]*quotaUsage)
+		uploadQuotas.mu.Unlock()
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var rateLimited atomic.Int64
+
+func init() {
+	metrics.register("http_rate_limited_total", rateLimited.Load)
+}
+
+// limited wraps fn so that each client gets its own token bucket for the
+// route, refilled at the route's rate with a burst of one second's worth.
+// Routes without a limit get fn back unchanged.
+func limited(method, pattern string, fn HandlerFunc) HandlerFunc {
+	rate, ok := routeLimits[method+" "+pattern]
+	if !ok {
+		rate = rateLimit
+	}
+	if rate <= 0 {
+		return fn
+	}
+	buckets := &bucketSet{rate: rate, buckets: make(map[string]*bucket)}
+	return func(req *Request, params map[string]string) string {
+		if !buckets.take(clientIP(req)) {
+			rateLimited.Add(1)
+			logInfo("Rate limit exceeded for", clientIP(req), method, pattern)
+			return createResponse("429 Too Many Requests", nil, "")
+		}
+		return fn(req, params)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet holds one route's buckets, by client address.
+type bucketSet struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+}
+
+// maxBuckets bounds the memory a flood of distinct clients can use; past it,
+// buckets that have refilled completely are forgotten, which loses nothing.
+const maxBuckets = 10000
+
+func (bs *bucketSet) take(client string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	now := time.Now()
+	burst := max(bs.rate, 1)
+	b, ok := bs.buckets[client]
+	if !ok {
+		if len(bs.buckets) >= maxBuckets {
+			bs.prune(now, burst)
+		}
+		b = &bucket{tokens: burst, last: now}
+		bs.buckets[client] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*bs.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (bs *bucketSet) prune(now time.Time, burst float64) {
+	for client, b := range bs.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*bs.rate >= burst {
+			delete(bs.buckets, client)
+		}
+	}
+}
+
+type limitMap map[string]float64
+
+func (m limitMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m limitMap) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	method, pattern, _ := strings.Cut(k, " ")
+	rate, err := strconv.ParseFloat(v, 64)
+	if !ok || !validMethod(method) || !strings.HasPrefix(pattern, "/") || err != nil || rate < 0 {
+		return fmt.Errorf("expected METHOD /pattern=requests-per-second, got %q", s)
+	}
+	m[k] = rate
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRetryAfter(t *testing.T) {
+	set(t, &rateLimit, 1)
+	withRouter(t)
+	do(t, request("GET", "/", nil))
+	if resp, _ := do(t, request("GET", "/", nil)); resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("rate limited: got %d with Retry-After %q, want 429 with 1", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	set(t, &retryAfter, 30)
+	client, server := net.Pipe()
+	defer client.Close()
+	go reject(server)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("saturated: got %d with Retry-After %q, want 503 with 30", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	set(t, &retryAfter, 0)
+	if out := createResponse("503 Service Unavailable", nil, ""); strings.Contains(out, "Retry-After") {
+		t.Errorf("-retry-after 0: got %q", out)
+	}
+}
+
+func TestRouteLimit(t *testing.T) {
+	withDir(t)
+	set(t, &rateLimit, 100)
+	limits := limitMap{}
+	if err := limits.Set("POST /files/*filename=1"); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &routeLimits, limits)
+	withRouter(t)
+	var writes, reads []int
+	for i := 0; i < 3; i++ {
+		resp, _ := do(t, request("POST", "/files/x", nil, "x"))
+		writes = append(writes, resp.StatusCode)
+		resp, _ = do(t, request("GET", "/echo/x", nil))
+		reads = append(reads, resp.StatusCode)
+	}
+	if writes[0] != 201 || writes[1] != 429 || writes[2] != 429 {
+		t.Errorf("POST /files/x statuses %v, want 201 then 429s", writes)
+	}
+	for _, status := range reads {
+		if status != 200 {
+			t.Errorf("GET /echo/x statuses %v, want every one 200", reads)
+			break
+		}
+	}
+	if err := limits.Set("/files=1"); err == nil {
+		t.Error("a limit without a method was accepted")
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxHeaderLineLength bounds a single header line, terminator included.
+const maxHeaderLineLength = 8192
+
+var errLineTooLong = errors.New("line too long")
+
+// errRequestTooLarge is wrapped by every -max-request-bytes and -max-body-size
+// rejection.
+var errRequestTooLarge = errors.New("request too large")
+
+// overBudget reports a request whose head or body (what) is n bytes, or at
+// least that, as too large.
+func overBudget(what string, n int64) error {
+	return &statusError{"413 Content Too Large", fmt.Errorf("%w: %d-byte %s", errRequestTooLarge, n, what)}
+}
+
+// bodyLimit is how many body bytes a request with headSize bytes of head may
+// send under -max-body-size and -max-request-bytes, or -1 for no limit.
+func bodyLimit(headSize int64) int64 {
+	limit := int64(-1)
+	if maxBodySize > 0 {
+		limit = maxBodySize
+	}
+	if maxRequestBytes > 0 && (limit < 0 || maxRequestBytes-headSize < limit) {
+		limit = maxRequestBytes - headSize // the head has already been checked against it
+	}
+	return limit
+}
+
+// statusError is a parse error that maps to a specific response status rather
+// than the default 400.
+type statusError struct {
+	status string
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+// Request is a parsed HTTP request. Header names are lowercased. Path is the
+// percent-decoded path of Target, and Query its still-encoded query string.
+type Request struct {
+	Method  string
+	Target  string
+	Path    string
+	Query   string
+	Version string
+	Headers map[string]string
+
+	// Body streams the request body straight off the connection, with any
+	// transfer codings already undone. Whatever a handler leaves unread is
+	// discarded before the next request on the connection is read, unless it
+	// refused the request without reading any, in which case the connection
+	// closes instead.
+	Body          io.Reader
+	ContentLength int64 // -1 for a chunked body
+
+	rawBody  io.Reader // the body as framed on the wire, before transfer codings are undone
+	bodyRead bool      // set by the first read of rawBody
+
+	RemoteAddr string // the peer's host:port, which may be a proxy
+	ID         string // from X-Request-Id, or generated, and echoed in the response
+
+	conn   net.Conn      // for handlers that stream their own response
+	reader *bufio.Reader // conn's reader, holding whatever the client sent past this request
+
+	response *Response // a streamed body for serveRequest to send after the handler's head
+
+	headerCount int // header fields parsed, before repeated ones were joined
+
+	// desync is set when what follows the body can't be the start of another
+	// request, so the connection must close rather than misread it as one.
+	desync bool
+}
+
+// readRequest reads the request line and headers of one request off r line by
+// line, leaving the body in r behind req.Body. Reads block until each piece is
+// complete, so it doesn't matter how the request was split into TCP segments.
+// It returns io.EOF if r ends before the first byte. A 100 Continue, if the
+// client asked for one, is written to w when the body is first read.
+func readRequest(r *bufio.Reader, w io.Writer) (*Request, error) {
+	line, err := readLine(r, maxTargetLength+64) // room for the method and version around the target
+	if err == errLineTooLong {
+		return nil, &statusError{"414 URI Too Long", fmt.Errorf("request line exceeds %d bytes", maxTargetLength+64)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(line) + 2) // the head so far, counting each terminator as CRLF
+	requestLine := strings.Split(line, " ")
+	if len(requestLine) != 3 {
+		return nil, fmt.Errorf("malformed request line: %q", line) // a raw space in the target ends up here
+	}
+	if len(requestLine[1]) > maxTargetLength {
+		return nil, &statusError{"414 URI Too Long", fmt.Errorf("request target is %d bytes", len(requestLine[1]))}
+	}
+	if !validTarget(requestLine[1]) {
+		return nil, fmt.Errorf("invalid character in request target: %q", requestLine[1])
+	}
+
+	var lines []string
+	for {
+		line, err := readLine(r, maxHeaderLineLength)
+		if err == errLineTooLong {
+			return nil, &statusError{"431 Request Header Fields Too Large", fmt.Errorf("header line exceeds %d bytes", maxHeaderLineLength)}
+		}
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF // the head must end with an empty line
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += int64(len(line) + 2)
+		if maxRequestBytes > 0 && size > maxRequestBytes {
+			return nil, overBudget("head", size)
+		}
+		if strings.TrimSpace(line) == "" {
+			break // last line, done with headers
+		}
+		lines = append(lines, line)
+	}
+	fields, err := parseHeaders(lines)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(fields))
+	count := 0
+	for k, values := range fields {
+		count += len(values)
+		headers[k] = strings.Join(values, ", ") // repeated fields are equivalent to one comma-separated list
+		if maxHeaderValue > 0 && len(headers[k]) > maxHeaderValue {
+			// Checked after joining, so splitting a value over repeated
+			// fields doesn't get around it.
+			return nil, &statusError{"431 Request Header Fields Too Large", fmt.Errorf("%s value exceeds %d bytes", k, maxHeaderValue)}
+		}
+	}
+
+	if !validMethod(requestLine[0]) {
+		return nil, fmt.Errorf("invalid method: %q", requestLine[0])
+	}
+	rawPath, query, _ := strings.Cut(requestLine[1], "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("malformed request target: %w", err)
+	}
+	if strings.ContainsFunc(path, func(c rune) bool { return c < 0x20 || c == 0x7f }) {
+		// e.g. %0d%0a, which would let a path echoed into a header inject another one
+		return nil, fmt.Errorf("control character in decoded path: %q", path)
+	}
+	if !allowDoubleEncoding && stillEncoded(path) {
+		// Decoding happens exactly once, here; anything that decodes to
+		// another escape, like %252e to %2e, is someone hoping a later
+		// layer decodes it again.
+		return nil, fmt.Errorf("percent-encoded sequence in decoded path: %q", path)
+	}
+	req := &Request{Method: requestLine[0], Target: requestLine[1], Path: path, Query: query, Version: requestLine[2], Headers: headers, headerCount: count}
+	if err := setBody(req, r, w, size); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// parseHeaders parses header field lines into lowercased names and their
+// values in the order they appeared, trimmed of surrounding whitespace. Lines
+// without a colon (or with whitespace before it) are skipped, or with -strict,
+// rejected.
+func parseHeaders(lines []string) (map[string][]string, error) {
+	headers := make(map[string][]string)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			if strict {
+				return nil, fmt.Errorf("malformed header line: %q", line)
+			}
+			continue
+		}
+		if strict && strings.TrimRight(name, " \t") != name {
+			return nil, fmt.Errorf("whitespace before colon in header: %q", line)
+		}
+		k := strings.TrimSpace(strings.ToLower(name))
+		headers[k] = append(headers[k], strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// setBody works out how the body of req is framed, from Transfer-Encoding or
+// Content-Length, and puts a reader for it in req.Body. Transfer codings are
+// undone in the reverse of the order they're listed in, chunked framing first.
+// headSize is what the request line and headers took up, which counts against
+// -max-request-bytes along with the body.
+func setBody(req *Request, r *bufio.Reader, w io.Writer, headSize int64) error {
+	te, chunked := req.Headers["transfer-encoding"]
+	cl, sized := req.Headers["content-length"]
+	var codings []string
+	switch {
+	case chunked && sized:
+		// Proxies disagree on which one wins, which is how requests get smuggled.
+		return fmt.Errorf("both Transfer-Encoding and Content-Length present")
+	case chunked:
+		for _, coding := range strings.Split(strings.ToLower(te), ",") {
+			codings = append(codings, strings.TrimSpace(coding))
+		}
+		if codings[len(codings)-1] != "chunked" {
+			return fmt.Errorf("Transfer-Encoding %q doesn't end in chunked", te) // so the body's end can't be found
+		}
+		codings = codings[:len(codings)-1]
+		for _, coding := range codings {
+			if coding != "gzip" && coding != "x-gzip" {
+				return &statusError{"501 Not Implemented", fmt.Errorf("unsupported transfer coding %q", coding)}
+			}
+		}
+		req.rawBody, req.ContentLength = &chunkedReader{r: r}, -1
+		if limit := bodyLimit(headSize); limit >= 0 {
+			req.rawBody = &budgetReader{r: req.rawBody, limit: limit}
+		}
+	case sized:
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || strings.TrimLeft(cl, "0123456789") != "" { // ParseInt would also take "+5"
+			return fmt.Errorf("malformed Content-Length: %q", cl)
+		}
+		if limit := bodyLimit(headSize); limit >= 0 && n > limit {
+			return overBudget("body", n) // refused before a byte of it is read, or a 100 Continue sent
+		}
+		if n == 0 && strayBody(r) {
+			if strict {
+				return fmt.Errorf("body bytes after Content-Length: 0")
+			}
+			req.desync = true
+		}
+		if strict && wantsClose(req) && int64(r.Buffered()) > n {
+			// Nothing may follow the last request on a connection, so extra
+			// bytes are a sign of a framing disagreement, i.e. smuggling.
+			return fmt.Errorf("%d bytes after the body of the connection's last request", int64(r.Buffered())-n)
+		}
+		req.rawBody, req.ContentLength = &bodyReader{r: r, remaining: n}, n
+	default:
+		req.rawBody = &bodyReader{r: r}
+	}
+	marker := &readMarker{r: req.rawBody, req: req}
+	req.rawBody = marker
+	hasBody := req.ContentLength != 0
+
+	if hasBody && (req.Method == "GET" || req.Method == "HEAD") && rejectGetBody {
+		// Otherwise the body is drained after the response, so it can't be mistaken for the next request.
+		return fmt.Errorf("%s request with a body", req.Method)
+	}
+	if expect, ok := req.Headers["expect"]; ok {
+		if !strings.EqualFold(expect, "100-continue") {
+			return &statusError{"417 Expectation Failed", fmt.Errorf("unsupported expectation %q", expect)}
+		}
+		if hasBody {
+			// Deferred to the handler's first read, so a request refused
+			// without its body is answered without the client sending it.
+			marker.wire, marker.continueTo = r, w
+		}
+	}
+
+	req.Body = req.rawBody
+	for i := len(codings) - 1; i >= 0; i-- {
+		gz, err := gzip.NewReader(req.Body) // only gzip makes it past the check above
+		if err != nil {
+			return fmt.Errorf("decoding %s transfer coding: %w", codings[i], err)
+		}
+		req.Body = gz
+	}
+	if limit := bodyLimit(headSize); limit >= 0 && len(codings) > 0 {
+		// The limits are on what's stored, and a few KB of gzip can expand to
+		// gigabytes, so the decoded body is held to them as well.
+		req.Body = &budgetReader{r: req.Body, limit: limit}
+	}
+	return nil
+}
+
+// budgetReader fails a chunked or decoded body with errRequestTooLarge once it
+// runs past limit, its bodyLimit. Only chunk data counts; -max-chunks already
+// bounds the framing around it.
+type budgetReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n, overBudget("body", b.read)
+	}
+	return n, err
+}
+
+// readMarker sets req.bodyRead on the first read of r, so serveRequest can
+// tell a handler that refused a request unread. If continueTo is set the
+// client sent Expect: 100-continue, and the first read prompts it for the body
+// with a 100 Continue.
+type readMarker struct {
+	r   io.Reader
+	req *Request
+
+	wire       *bufio.Reader // the connection's reader, holding the body if it has already arrived
+	continueTo io.Writer
+}
+
+func (m *readMarker) Read(p []byte) (int, error) {
+	if !m.req.bodyRead {
+		m.req.bodyRead = true
+		// An impatient client may already have sent the body instead of
+		// waiting; only prompt for it if nothing has arrived yet.
+		if m.continueTo != nil && m.wire.Buffered() == 0 {
+			if _, err := io.WriteString(m.continueTo, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return m.r.Read(p)
+}
+
+// bodyReader reads up to remaining bytes from r, reporting
+// io.ErrUnexpectedEOF if r ends first so a truncated upload isn't mistaken for
+// a complete one.
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readLine reads up to and including the next '\n' and returns the line
+// without its terminator. Lines longer than limit yield errLineTooLong; with
+// -strict-crlf, a line ending in a bare LF is an error.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if strictCRLF && !bytes.HasSuffix(line, []byte("\r\n")) {
+		return "", fmt.Errorf("line ends in a bare LF: %q", line)
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// stillEncoded reports whether path contains a %XX escape.
+func stillEncoded(path string) bool {
+	for i := strings.IndexByte(path, '%'); i >= 0; i = strings.IndexByte(path, '%') {
+		if len(path) >= i+3 && isHex(path[i+1]) && isHex(path[i+2]) {
+			return true
+		}
+		path = path[i+1:]
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// strayBody reports whether the bytes already buffered after the headers look
+// like a body rather than a pipelined request line, which has to start with a
+// method we know. It never blocks: if nothing has arrived yet there's nothing
+// to judge.
+func strayBody(r *bufio.Reader) bool {
+	next, _ := r.Peek(r.Buffered())
+	if len(next) == 0 {
+		return false
+	}
+	for _, method := range knownMethods {
+		start := method + " "
+		if strings.HasPrefix(string(next), start) || strings.HasPrefix(start, string(next)) {
+			return false // a request line, or the first bytes of one
+		}
+	}
+	return true
+}
+
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// validMethod reports whether method is well-formed, which in RFC 9110 is any
+// token.
+func validMethod(method string) bool {
+	return validToken(method)
+}
+
+// validToken reports whether s is a non-empty RFC 9110 token.
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validTarget reports whether target only uses characters RFC 3986 allows in a
+// URI: unreserved, gen-delims, sub-delims and '%' for percent-encoding.
+func validTarget(target string) bool {
+	if target == "" {
+		return false
+	}
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// chunkedReader decodes a chunked body: hex chunk sizes, each followed by
+// that many bytes and a CRLF, up to a zero-size chunk and optional trailer
+// fields, which are skipped.
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64 // bytes left in the current chunk
+	chunks    int
+	started   bool
+	err       error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // the last chunk hasn't been seen yet
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads the next chunk-size line, or at the last chunk, the
+// trailer section, returning io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	if c.started {
+		line, err := readLine(c.r, 2)
+		if err != nil {
+			return noEOF(err)
+		}
+		if line != "" {
+			return fmt.Errorf("chunk data not followed by CRLF")
+		}
+	}
+	c.started = true
+	line, err := readLine(c.r, maxHeaderLineLength)
+	if err != nil {
+		return noEOF(err)
+	}
+	size, _, _ := strings.Cut(line, ";") // chunk extensions are ignored
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("malformed chunk size %q", line)
+	}
+	if n > 0 {
+		if c.chunks++; maxChunks > 0 && c.chunks > maxChunks {
+			return fmt.Errorf("more than %d chunks", maxChunks) // each costs a line parse for as little as a byte of body
+		}
+		c.remaining = n
+		return nil
+	}
+	for {
+		line, err := readLine(c.r, maxHeaderLineLength)
+		if err != nil {
+			return noEOF(err)
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+// noEOF turns a clean EOF into io.ErrUnexpectedEOF for places where the
+// stream mustn't end.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestZeroLengthWithStrayBody sends Content-Length: 0 followed by bytes that
+// aren't a request line, which mustn't be taken for the next request.
+func TestZeroLengthWithStrayBody(t *testing.T) {
+	raw := "GET /echo/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\nstray bytes"
+
+	resps := parseResponses(t, exchange(t, raw), "GET")
+	if len(resps) != 1 || resps[0].StatusCode != 200 || !resps[0].Close {
+		t.Errorf("lenient: got %d responses, want one 200 that closes the connection", len(resps))
+	}
+
+	set(t, &strict, true)
+	resps = parseResponses(t, exchange(t, raw), "GET")
+	if len(resps) != 1 || resps[0].StatusCode != 400 {
+		t.Errorf("strict: got %d responses, want one 400", len(resps))
+	}
+}
+
+func TestZeroLengthThenPipelined(t *testing.T) {
+	raw := "GET /echo/a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n" + request("GET", "/echo/b", nil)
+	resps := parseResponses(t, exchange(t, raw), "GET")
+	if len(resps) != 2 || resps[0].body != "a" || resps[1].body != "b" {
+		t.Fatalf("got %d responses, want /echo/a then /echo/b", len(resps))
+	}
+}
+
+// parse reads one request from raw.
+func parse(raw string) (*Request, error) {
+	return readRequest(bufio.NewReader(strings.NewReader(raw)), io.Discard)
+}
+
+func TestLineEndings(t *testing.T) {
+	crlf := "GET /echo/a HTTP/1.1\r\nHost: localhost\r\nUser-Agent: x\r\n\r\n"
+	lf := strings.ReplaceAll(crlf, "\r\n", "\n")
+	for _, strictMode := range []bool{false, true} {
+		set(t, &strictCRLF, strictMode)
+		if req, err := parse(crlf); err != nil || req.Headers["user-agent"] != "x" {
+			t.Errorf("-strict-crlf=%v: CRLF request: %v", strictMode, err)
+		}
+		req, err := parse(lf)
+		if strictMode && err == nil {
+			t.Errorf("-strict-crlf: bare-LF request parsed")
+		}
+		if !strictMode && (err != nil || req.Headers["user-agent"] != "x" || req.Path != "/echo/a") {
+			t.Errorf("bare-LF request: %v", err)
+		}
+	}
+}
+
+func TestTargetCharacters(t *testing.T) {
+	for _, target := range []string{"/echo/a b", "/echo/a\x01b", "/echo/a\x7fb", "/echo/a%01b"} {
+		if _, err := parse("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"); err == nil {
+			t.Errorf("target %q parsed", target)
+		}
+	}
+	resp, _ := do(t, "GET /echo/a\x01b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != 400 {
+		t.Errorf("control byte in target: status %d, want 400", resp.StatusCode)
+	}
+	if req, err := parse("GET /echo/a%20b HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || req.Path != "/echo/a b" {
+		t.Errorf("an escaped space is fine: %v", err)
+	}
+}
+
+func TestBufferedPipelined(t *testing.T) {
+	keep := func(text string) string { return "GET /echo/" + text + " HTTP/1.1\r\nHost: localhost\r\n\r\n" }
+	resps := parseResponses(t, exchange(t, keep("one")+keep("two")+request("GET", "/echo/three", nil)), "GET")
+	if len(resps) != 3 || resps[0].body != "one" || resps[1].body != "two" || resps[2].body != "three" {
+		t.Fatalf("got %d responses, want one, two, three in order", len(resps))
+	}
+}
+
+func TestBufferedChunked(t *testing.T) {
+	dir := withDir(t)
+	upload := "POST /files/chunked HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\n\r\n"
+	resps := parseResponses(t, exchange(t, upload+request("GET", "/files/chunked", nil)), "GET")
+	if len(resps) != 2 || resps[0].StatusCode != 201 || resps[1].body != "hello, world" {
+		t.Fatalf("got %d responses, want a 201 then the stored body", len(resps))
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "chunked")); string(got) != "hello, world" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestSegmentedRequest(t *testing.T) {
+	dir := withDir(t)
+	raw := request("POST", "/files/split", []string{"Content-Type: text/plain"}, "hello, segmented world")
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		last := 0
+		for _, cut := range []int{3, 20, len(raw) - 10, len(raw) - 4, len(raw)} { // mid-line, mid-head and mid-body
+			io.WriteString(c, raw[last:cut])
+			last = cut
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Fatalf("status %d, want 201", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "split")); string(got) != "hello, segmented world" {
+		t.Errorf("file holds %q", got)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	withDir(t)
+	raw := request("POST", "/files/x", []string{"Expect: 100-continue"}, "body")
+	if out := exchange(t, raw); strings.Contains(out, "100 Continue") || !strings.HasPrefix(out, "HTTP/1.1 201 ") {
+		t.Errorf("with the body sent at once: got %q, want just the 201", out)
+	}
+
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+	go io.WriteString(c, head+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != 100 {
+		t.Fatalf("waiting client: got %v, %v; want a 100 Continue", resp, err)
+	}
+	go io.WriteString(c, body)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != 201 {
+		t.Errorf("after the body: got %v, %v; want a 201", resp, err)
+	}
+
+	set(t, &uploadQuota, 1)
+	forgetQuotas(t)
+	c = dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(c, head+"\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || resp.StatusCode != 413 {
+		t.Errorf("upload refused unread: got %v, %v; want a 413 with no 100 Continue first", resp, err)
+	}
+}
+
+func TestGetWithBody(t *testing.T) {
+	get := "GET /echo/a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"
+	raw := get + request("GET", "/echo/b", nil)
+	resps := parseResponses(t, exchange(t, raw), "GET")
+	if len(resps) != 2 || resps[0].StatusCode != 200 || resps[0].body != "a" || resps[1].body != "b" {
+		t.Errorf("the body wasn't discarded: got %v", resps)
+	}
+	set(t, &rejectGetBody, true)
+	if resps := parseResponses(t, exchange(t, raw), "GET"); len(resps) != 1 || resps[0].StatusCode != 400 {
+		t.Errorf("with -reject-get-body: got %v, want one 400", resps)
+	}
+}
+
+func TestGzipTransferCoding(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("decoded body"))
+	zw.Close()
+	half := gz.Len() / 2
+	chunked := fmt.Sprintf("%x\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", half, gz.Bytes()[:half], gz.Len()-half, gz.Bytes()[half:])
+	req, err := parse("POST /files/x HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" + chunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(req.Body); err != nil || string(body) != "decoded body" {
+		t.Errorf("got %q, %v", body, err)
+	}
+	if _, err := parse("POST /files/x HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked, gzip\r\n\r\n" + chunked); err == nil {
+		t.Error("chunked before gzip was accepted")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		lines  []string
+		want   map[string][]string
+		strict bool // whether -strict rejects the lines
+	}{
+		{[]string{"Accept: a", "ACCEPT: b"}, map[string][]string{"accept": {"a", "b"}}, false},
+		{[]string{"X-A:   padded \t"}, map[string][]string{"x-a": {"padded"}}, false},
+		{[]string{"X-Empty:", "X-Blank:   "}, map[string][]string{"x-empty": {""}, "x-blank": {""}}, false},
+		{[]string{"no colon", "X-A: 1"}, map[string][]string{"x-a": {"1"}}, true},
+		{[]string{": no name"}, map[string][]string{}, true},
+		{[]string{"X-A : 1"}, map[string][]string{"x-a": {"1"}}, true},
+		{[]string{"X-A: b: c"}, map[string][]string{"x-a": {"b: c"}}, false},
+	} {
+		got, err := parseHeaders(tc.lines)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseHeaders(%q) = %q, %v; want %q", tc.lines, got, err, tc.want)
+		}
+		strict = true
+		_, err = parseHeaders(tc.lines)
+		strict = false
+		if (err != nil) != tc.strict {
+			t.Errorf("strict parseHeaders(%q): error %v", tc.lines, err)
+		}
+	}
+}
+
+func TestTargetInjection(t *testing.T) {
+	for _, target := range []string{"/echo/a%0d%0aSet-Cookie:%20x=1", "/echo/a%0Ab", "/echo/a%0db", "/echo/a\rSet-Cookie: x=1"} {
+		if _, err := parse("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"); err == nil {
+			t.Errorf("target %q parsed", target)
+		}
+	}
+	out := exchange(t, request("GET", "/echo/a%0d%0aSet-Cookie:%20x=1", nil))
+	if !strings.HasPrefix(out, "HTTP/1.1 400 ") || strings.Contains(out, "Set-Cookie") {
+		t.Errorf("got %q, want a 400 with nothing injected", out)
+	}
+}
+
+func TestDoubleEncodedTraversal(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "served")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &directory, dir)
+	if err := os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/files/%252e%252e/secret", "/files/%252E%252E%252Fsecret"} {
+		if resp, body := do(t, request("GET", target, nil)); resp.StatusCode != 400 || body == "secret" {
+			t.Errorf("%s: got %d %q, want a 400", target, resp.StatusCode, body)
+		}
+	}
+	if req, err := parse("GET /echo/100%25 HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || req.Path != "/echo/100%" {
+		t.Errorf("a lone escaped percent: got %+v, %v", req, err)
+	}
+}
+
+func TestRequestLineOnly(t *testing.T) {
+	set(t, &idleTimeout, 100*time.Millisecond)
+	c, done := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, "GET / HTTP/1.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(c)
+	<-done
+	if err != nil || !strings.HasPrefix(string(out), "HTTP/1.1 408 ") {
+		t.Errorf("got %q, %v; want a 408 once the headers don't arrive", out, err)
+	}
+}
+
+func TestMaxChunks(t *testing.T) {
+	dir := withDir(t)
+	set(t, &maxChunks, 3)
+	chunked := func(n int) string {
+		return "POST /files/c HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n" + strings.Repeat("1\r\nx\r\n", n) + "0\r\n\r\n"
+	}
+	if resp, _ := do(t, chunked(3)); resp.StatusCode != 201 {
+		t.Errorf("3 chunks: status %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := do(t, chunked(4)); resp.StatusCode != 400 {
+		t.Errorf("4 chunks: status %d, want 400", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "c")); string(got) != "xxx" {
+		t.Errorf("file holds %q, want the 3-chunk upload", got)
+	}
+}
+
+func TestOversizedHeaderValue(t *testing.T) {
+	set(t, &maxHeaderValue, 100)
+	if resp, _ := do(t, request("GET", "/", []string{"Cookie: " + strings.Repeat("c", 101)})); resp.StatusCode != 431 {
+		t.Errorf("101-byte value: status %d, want 431", resp.StatusCode)
+	}
+	if resp, _ := do(t, request("GET", "/", []string{"Cookie: " + strings.Repeat("c", 100)})); resp.StatusCode != 200 {
+		t.Errorf("100-byte value: status %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := do(t, request("GET", "/", []string{"Cookie: " + strings.Repeat("c", 60), "Cookie: " + strings.Repeat("d", 60)})); resp.StatusCode != 431 {
+		t.Errorf("repeated fields over the limit together: status %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	dir := withDir(t)
+	raw := request("POST", "/files/g", nil, "body") + "GET /smuggled HTTP/1.1\r\n\r\n"
+	if resps := parseResponses(t, exchange(t, raw), "POST"); len(resps) != 1 || resps[0].StatusCode != 201 {
+		t.Errorf("lenient: got %v, want just a 201", resps)
+	}
+	os.Remove(filepath.Join(dir, "g"))
+	set(t, &strict, true)
+	if resps := parseResponses(t, exchange(t, raw), "POST"); len(resps) != 1 || resps[0].StatusCode != 400 {
+		t.Errorf("strict: got %v, want one 400", resps)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "g")); err == nil {
+		t.Error("strict: the upload was stored anyway")
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	withDir(t)
+	fits := request("POST", "/files/b", nil, "0123456789")
+	set(t, &maxRequestBytes, int64(len(fits)))
+	if resp, _ := do(t, fits); resp.StatusCode != 201 {
+		t.Errorf("exactly the budget: status %d, want 201", resp.StatusCode)
+	}
+	for name, raw := range map[string]string{
+		"body":    request("POST", "/files/b", nil, "0123456789a"),
+		"headers": request("GET", "/", []string{"X-Pad: " + strings.Repeat("p", len(fits))}),
+		"chunked": "POST /files/b HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n" + strings.Repeat("a\r\n0123456789\r\n", 10) + "0\r\n\r\n",
+	} {
+		if resp, _ := do(t, raw); resp.StatusCode != 413 || !resp.Close {
+			t.Errorf("over the budget in the %s: got %d, close %v; want a 413 that closes", name, resp.StatusCode, resp.Close)
+		}
+	}
+}
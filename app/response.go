@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// header is one response header field.
+type header struct{ name, value string }
+
+// headerList holds a response's header fields in the order they're sent.
+type headerList []header
+
+// sort puts h in a stable order: the names in -header-order first, in that
+// order, then the rest alphabetically.
+func (h headerList) sort() {
+	slices.SortFunc(h, func(a, b header) int {
+		ra, oka := headerOrder.rank[strings.ToLower(a.name)]
+		rb, okb := headerOrder.rank[strings.ToLower(b.name)]
+		switch {
+		case oka && okb:
+			return ra - rb
+		case oka:
+			return -1
+		case okb:
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// String serializes h as header lines, each ending in CRLF.
+func (h headerList) String() string {
+	var b strings.Builder
+	for _, f := range h {
+		name := f.name
+		if canonicalHeaders {
+			name = textproto.CanonicalMIMEHeaderKey(name) // note this turns ETag into Etag
+		}
+		b.WriteString(name + ": " + f.value + "\r\n")
+	}
+	return b.String()
+}
+
+// headerOrder is -header-order, parsed once rather than for every response.
+var headerOrder orderFlag
+
+// orderFlag is a comma-separated list of header names, ranked by position.
+type orderFlag struct {
+	names []string
+	rank  map[string]int // keyed by lowercased name
+}
+
+func (o *orderFlag) String() string { return strings.Join(o.names, ",") }
+
+func (o *orderFlag) Set(s string) error {
+	o.names, o.rank = nil, make(map[string]int)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if _, dup := o.rank[strings.ToLower(name)]; name == "" || dup {
+			continue
+		}
+		o.rank[strings.ToLower(name)] = len(o.names)
+		o.names = append(o.names, name)
+	}
+	return nil
+}
+
+// responseBuffer collects a response body for handlers that build it up in
+// pieces. Nothing is sent until close serializes it, so Content-Length is
+// counted from the bytes actually written rather than by the handler.
+type responseBuffer struct {
+	status  string
+	headers map[string]string
+
+	// acceptEncoding, if set, is the client's Accept-Encoding, and close
+	// gzips the body when it and the Content-Type allow.
+	acceptEncoding string
+
+	body bytes.Buffer
+}
+
+func newResponseBuffer(status string, contentType string) *responseBuffer {
+	return &responseBuffer{status: status, headers: map[string]string{"Content-Type": contentType}}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteString(s string) (int, error) {
+	return b.body.WriteString(s)
+}
+
+// close returns the serialized response. The buffer isn't used after.
+func (b *responseBuffer) close() string {
+	body := b.body.String()
+	if b.acceptEncoding != "" {
+		body = compressBody(body, b.acceptEncoding, b.headers)
+	}
+	return createResponse(b.status, b.headers, body) // which sets Content-Length to len(body)
+}
+
+// Response is a response whose body streams from Body instead of being held
+// in a string, so a large file goes out with constant memory. Body supplies
+// exactly ContentLength bytes. done, if set, runs once the body has been sent
+// or abandoned, to release whatever Body reads from.
+type Response struct {
+	Status        string
+	Headers       map[string]string
+	Body          io.Reader
+	ContentLength int64
+
+	done func()
+}
+
+// stream has serveRequest send resp's body after its head, which is what
+// stream returns for the handler to return. The head states the length, so
+// the connection stays open for the next request.
+func stream(req *Request, resp *Response) string {
+	if resp.Headers == nil {
+		resp.Headers = make(map[string]string)
+	}
+	resp.Headers["Content-Length"] = strconv.FormatInt(resp.ContentLength, 10)
+	req.response = resp
+	return createResponse(resp.Status, resp.Headers, "")
+}
+
+// sendBody copies resp's body to out. Falling short of ContentLength is an
+// error too, as the client would be left waiting for the rest.
+func sendBody(out io.Writer, resp *Response) error {
+	n, err := io.Copy(out, io.LimitReader(resp.Body, resp.ContentLength))
+	if err == nil && n < resp.ContentLength {
+		err = io.ErrUnexpectedEOF // e.g. the file was truncated while being sent
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestHeaderOrder(t *testing.T) {
+	headers := map[string]string{"X-B": "2", "Content-Type": "text/plain", "X-A": "1", "ETag": `"t"`, "Content-Encoding": "gzip"}
+	want := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\nContent-Encoding: gzip\r\nETag: \"t\"\r\nX-A: 1\r\nX-B: 2\r\n\r\nhi"
+	for i := 0; i < 10; i++ { // map iteration order differs from run to run
+		if got := createResponse("200 OK", headers, "hi"); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	var order orderFlag
+	order.Set("x-b, etag,,X-B")
+	set(t, &headerOrder, order)
+	want = "HTTP/1.1 200 OK\r\nX-B: 2\r\nETag: \"t\"\r\nContent-Encoding: gzip\r\nContent-Length: 2\r\nContent-Type: text/plain\r\nX-A: 1\r\n\r\nhi"
+	if got := createResponse("200 OK", headers, "hi"); got != want {
+		t.Errorf("with -header-order %q: got %q, want %q", order.String(), got, want)
+	}
+	if got := order.String(); got != "x-b,etag" {
+		t.Errorf("-header-order is %q, want duplicates and empty names dropped", got)
+	}
+
+	order.Set("Connection,X-Request-Id,Content-Type")
+	set(t, &headerOrder, order)
+	raw := exchange(t, request("GET", "/echo/hi", []string{"X-Request-Id: abc"}))
+	head, _, _ := strings.Cut(raw, "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	if len(lines) < 4 || lines[1] != "Connection: close" || lines[2] != "X-Request-Id: abc" || !strings.HasPrefix(lines[3], "Content-Type: ") {
+		t.Errorf("with -header-order %q, a served response's head is %q", order.String(), head)
+	}
+}
+
+// TestStreamErrorClosesConnection fails a streamed body partway, after the
+// 200 has gone out: the connection is closed short of Content-Length, with
+// nothing appended, and the next pipelined request isn't answered.
+func TestStreamErrorClosesConnection(t *testing.T) {
+	withRouter(t)
+	router.Handle("GET", "/failing", func(req *Request, _ map[string]string) string {
+		body := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("disk gone")))
+		return stream(req, &Response{Status: "200 OK", Body: body, ContentLength: 100})
+	})
+	keep := "GET /failing HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	out := exchange(t, keep+request("GET", "/", nil))
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	if !strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n") || !strings.Contains(head, "Content-Length: 100") {
+		t.Fatalf("head is %q", head)
+	}
+	if body != "partial" {
+		t.Errorf("got body %q, want just %q before the connection closed", body, "partial")
+	}
+}
+
+// TestTruncatedFileClosesConnection truncates a file while it's being sent.
+func TestTruncatedFileClosesConnection(t *testing.T) {
+	dir := withDir(t)
+	file := filepath.Join(dir, "big")
+	if err := os.WriteFile(file, make([]byte, 16<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(c, request("GET", "/files/big", nil))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != io.ErrUnexpectedEOF || n >= 16<<20 {
+		t.Errorf("read %d bytes with error %v, want the body cut short", n, err)
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	want := "HTTP/1.1 204 No Content\r\nX-A: 1\r\n\r\n"
+	if got := createResponse("204 No Content", map[string]string{"X-A": "1", "Content-Length": "4"}, "body"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := createResponse("200 OK", map[string]string{"X-A": "1"}, ""); got != "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nX-A: 1\r\n\r\n" {
+		t.Errorf("without -empty-204: got %q", got)
+	}
+	set(t, &empty204, true)
+	if got := createResponse("200 OK", map[string]string{"X-A": "1"}, ""); got != want {
+		t.Errorf("with -empty-204: got %q, want %q", got, want)
+	}
+}
+
+func TestCanonicalHeaders(t *testing.T) {
+	headers := map[string]string{"content-type": "text/plain", "x-custom-thing": "1"}
+	if got := createResponse("200 OK", headers, ""); !strings.Contains(got, "\r\ncontent-type: text/plain\r\n") || !strings.Contains(got, "\r\nx-custom-thing: 1\r\n") {
+		t.Errorf("without -canonical-headers: got %q, want names as given", got)
+	}
+	set(t, &canonicalHeaders, true)
+	got := createResponse("200 OK", headers, "")
+	if !strings.Contains(got, "\r\nContent-Type: text/plain\r\n") || !strings.Contains(got, "\r\nX-Custom-Thing: 1\r\n") {
+		t.Errorf("got %q, want canonical names", got)
+	}
+	if got := addHeader(got, "x-added", "2"); !strings.Contains(got, "\r\nX-Added: 2\r\n") {
+		t.Errorf("addHeader: got %q", got)
+	}
+}
+
+func TestResponseBufferLength(t *testing.T) {
+	w := newResponseBuffer("200 OK", "text/plain; charset=utf-8")
+	w.WriteString("naïve café, ")
+	w.Write([]byte("日本語 ✓"))
+	body := "naïve café, 日本語 ✓"
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(w.close())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if resp.ContentLength != int64(len(body)) || string(got) != body {
+		t.Errorf("Content-Length %d with body %q, want %d bytes %q", resp.ContentLength, got, len(body), body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// HandlerFunc answers a request that matched a route. params holds the path
+// segments captured by the route's pattern, keyed by name without the leading
+// ':' or '*'. It returns the serialized response, or "" if it wrote its own
+// straight to the connection.
+type HandlerFunc func(req *Request, params map[string]string) string
+
+// Router dispatches requests by method and path pattern. A pattern is split
+// on '/'; a ":name" segment matches any single segment, including an empty
+// one, and a trailing "*name" segment matches the rest of the path, slashes and
+// all. Routes are tried in the order they were registered.
+type Router struct {
+	routes []routeEntry
+}
+
+type routeEntry struct {
+	method   string
+	segments []string
+	fn       HandlerFunc
+}
+
+// Handle registers fn for method and pattern, behind the route's rate limit
+// if one is configured.
+func (r *Router) Handle(method, pattern string, fn HandlerFunc) {
+	r.routes = append(r.routes, routeEntry{method, strings.Split(pattern, "/"), limited(method, pattern, fn)})
+}
+
+// Match finds the first route for method and path. If the path matches but
+// no route takes the method, fn is nil and allowed lists the methods that
+// would be accepted; if nothing matches the path, both are nil. HEAD is
+// served by GET routes unless one is registered for it explicitly.
+func (r *Router) Match(method, path string) (fn HandlerFunc, params map[string]string, allowed []string) {
+	var fallback HandlerFunc
+	var fallbackParams map[string]string
+	for _, rt := range r.routes {
+		p, ok := rt.match(path)
+		if !ok {
+			continue
+		}
+		if rt.method == method {
+			return rt.fn, p, nil
+		}
+		if method == "HEAD" && rt.method == "GET" && fallback == nil {
+			fallback, fallbackParams = rt.fn, p
+		}
+		allowed = appendMethod(allowed, rt.method)
+	}
+	if fallback != nil {
+		return fallback, fallbackParams, nil
+	}
+	if allowed == nil {
+		return nil, nil, nil
+	}
+	if i := slices.Index(allowed, "GET"); i >= 0 && !slices.Contains(allowed, "HEAD") {
+		allowed = slices.Insert(allowed, i+1, "HEAD")
+	}
+	return nil, nil, appendMethod(allowed, "OPTIONS")
+}
+
+// Allowed lists the methods accepted at path, including the implicit HEAD and
+// OPTIONS, or nil if no route matches it.
+func (r *Router) Allowed(path string) []string {
+	_, _, allowed := r.Match("", path) // no route is registered for the empty method
+	return allowed
+}
+
+func (rt routeEntry) match(path string) (map[string]string, bool) {
+	parts := strings.Split(path, "/")
+	params := map[string]string{}
+	for i, seg := range rt.segments {
+		if name, ok := strings.CutPrefix(seg, "*"); ok && i == len(rt.segments)-1 {
+			if i >= len(parts) {
+				return nil, false
+			}
+			params[name] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			params[name] = parts[i]
+		} else if seg != parts[i] {
+			return nil, false
+		}
+	}
+	return params, len(parts) == len(rt.segments)
+}
+
+func appendMethod(methods []string, method string) []string {
+	if slices.Contains(methods, method) {
+		return methods
+	}
+	return append(methods, method)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	r := &Router{}
+	for _, pattern := range []string{"/echo/:text", "/files/*name", "/"} {
+		pattern := pattern
+		r.Handle("GET", pattern, func(*Request, map[string]string) string { return pattern })
+	}
+	r.Handle("POST", "/files/*name", func(*Request, map[string]string) string { return "POST /files/*name" })
+
+	for _, tc := range []struct {
+		method, path, want string
+		params             map[string]string
+	}{
+		{"GET", "/echo/abc", "/echo/:text", map[string]string{"text": "abc"}},
+		{"GET", "/echo/", "/echo/:text", map[string]string{"text": ""}}, // an empty segment, not a panic
+		{"HEAD", "/echo/abc", "/echo/:text", map[string]string{"text": "abc"}},
+		{"GET", "/files/a/b.txt", "/files/*name", map[string]string{"name": "a/b.txt"}},
+		{"POST", "/files/a", "POST /files/*name", map[string]string{"name": "a"}},
+		{"GET", "/", "/", map[string]string{}},
+	} {
+		fn, params, allowed := r.Match(tc.method, tc.path)
+		if fn == nil {
+			t.Errorf("%s %s: no match (allowed %v)", tc.method, tc.path, allowed)
+			continue
+		}
+		if got := fn(nil, params); got != tc.want {
+			t.Errorf("%s %s: matched %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+		for k, v := range tc.params {
+			if params[k] != v {
+				t.Errorf("%s %s: params %v, want %v", tc.method, tc.path, params, tc.params)
+			}
+		}
+	}
+
+	if fn, _, allowed := r.Match("POST", "/echo/abc"); fn != nil || !slices.Equal(allowed, []string{"GET", "HEAD", "OPTIONS"}) {
+		t.Errorf("POST /echo/abc: allowed %v, want a 405 with GET, HEAD, OPTIONS", allowed)
+	}
+	if fn, _, allowed := r.Match("GET", "/echo/a/b"); fn != nil || allowed != nil {
+		t.Errorf("GET /echo/a/b: matched, want a 404")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	resp, _ := do(t, request("POST", "/echo/abc", nil, "x"))
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("status %d, Allow %q, want 405 with GET, HEAD, OPTIONS", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestRegisteredRoutes(t *testing.T) {
+	withDir(t)
+	for _, tc := range []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/", 200, ""},
+		{"/echo/abc", 200, "abc"},
+		{"/echoanything", 404, ""},
+		{"/user-agentx", 404, ""},
+		{"/filesystem", 404, ""},
+		{"/files/missing", 404, ""},
+	} {
+		if resp, body := do(t, request("GET", tc.target, []string{"User-Agent: test"})); resp.StatusCode != tc.status || body != tc.body {
+			t.Errorf("GET %s: got %d %q, want %d %q", tc.target, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+	if _, body := do(t, request("GET", "/user-agent", []string{"User-Agent: test"})); body != "test" {
+		t.Errorf("GET /user-agent: got %q", body)
+	}
+}
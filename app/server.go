@@ -1,152 +1,1087 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
-	"unicode/utf8"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var directory string
+var strict bool
+var strictCRLF bool
+var fileRoutes = pathMap{}
+var robots string
+var redirects = pathMap{}
+var trailingSlash string
+var maxTargetLength int
+var charset string
+var logErrorsVerbose bool
+var notFoundMessage string
+var writeTimeout time.Duration
+var preloadFiles string
+var trustProxy bool
+var requestDeadline time.Duration
+var cacheControl string
+var empty204 bool
+var workers int
+var queueSize int
+var maxRequestsPerConn int
+var idleTimeout time.Duration
+var uploadTmpDir string
+var rejectGetBody bool
+var errorFormat string
+var listenAddrs stringList
+var tlsAddrs stringList
+var maxIdleConns int
+var enableMetrics bool
+var cacheAge bool
+var maxUploads int
+var favicon string
+var defaultEncoding string
+var retryAfter int
+var allowDoubleEncoding bool
+var compressTypes string
+var precompressed bool
+var rateLimit float64
+var linger time.Duration
+var writeBufferSize int
+var dirListing string
+var shareFileHandles bool
+var uploadBufferSize int
+var contentAddressed bool
+var uploadQuota int64
+var uploadQuotaWindow time.Duration
+var maxRanges int
+var drainTimeout time.Duration
+var noKeepAlive bool
+var uploadMemory int64
+var connectTunnel bool
+var maxChunks int
+var maintenance bool
+var maintenanceFile string
+var maintenanceMessage string
+var adminToken string
+var allowDelete bool
+var canonicalHeaders bool
+var maxHeaderValue int
+var maxRequestBytes int64
+var maxBodySize int64
+var slowRequestThreshold time.Duration
+var debugHeaders bool
+var logLevelName string
+var accessLog string
+var tlsCert string
+var tlsKey string
+var routeLimits = limitMap{} // keyed by method and pattern as registered, e.g. "POST /files/*filename"
 
 func main() {
-	fmt.Println("Application started...")
-	flag.StringVar(&directory, "directory", "", "The directory to read the file from")
+	defineFlags(flag.CommandLine)
 	flag.Parse()
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		logError("Invalid -log-level:", err)
+		os.Exit(1)
+	}
+	logLevel = level
+	if accessLog != "" && accessLog != "common" && accessLog != "json" {
+		logError("Invalid -access-log:", accessLog)
+		os.Exit(1)
+	}
+	logInfo("Application started...")
+	if defaultEncoding != "identity" && defaultEncoding != "gzip" {
+		logError("Invalid -default-encoding:", defaultEncoding)
+		os.Exit(1)
+	}
+	if maxUploads > 0 {
+		uploadSlots = make(chan struct{}, maxUploads)
+	}
+	if errorFormat != "text" && errorFormat != "json" {
+		logError("Invalid -error-format:", errorFormat)
+		os.Exit(1)
+	}
 	if directory != "" {
-		fmt.Printf("Reading from directory: %s", directory)
+		directory = filepath.Clean(directory) // so the traversal guard's prefix check sees one canonical form
 	}
-	l, err := net.Listen("tcp", "0.0.0.0:4221") // listening on the port
-	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
+	if uploadTmpDir != "" {
+		if err := checkTmpDir(); err != nil {
+			logError("Invalid -tmp-dir:", err)
+			os.Exit(1)
+		}
+	}
+	if dirListing != "" && dirListing != "html" && dirListing != "json" {
+		logError("Invalid -dir-listing:", dirListing)
 		os.Exit(1)
 	}
-	defer l.Close()
-
-	for { // typically web servers are implemented as infinitely running for-loops!
-		con, err := l.Accept() // when the client connects, accept the connection - this is a blocking call
-		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+	if uploadBufferSize < minUploadBufferSize {
+		logError("-upload-buffer-size must be at least", minUploadBufferSize)
+		os.Exit(1)
+	}
+	if tlsCert != "" || tlsKey != "" {
+		if err := loadTLS(); err != nil {
+			logError("Invalid -tls-cert or -tls-key:", err)
 			os.Exit(1)
 		}
-		fmt.Println("Connection accepted...")
-		go handle(con) // multi-threading with the go-routine allows for concurrent connections
 	}
+	if len(tlsAddrs) > 0 && tlsConfig.Load() == nil {
+		logError("-tls-addr needs -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+	if writeBufferSize < 1 {
+		logError("-write-buffer-size must be at least 1")
+		os.Exit(1)
+	}
+	if workers < 1 || queueSize < 0 {
+		logError("-workers must be at least 1 and -queue-size at least 0")
+		os.Exit(1)
+	}
+	if err := preload(preloadFiles); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+	if trailingSlash != "" && trailingSlash != "add" && trailingSlash != "strip" {
+		logError("Invalid -trailing-slash policy:", trailingSlash)
+		os.Exit(1)
+	}
+	for from, to := range redirects {
+		if _, _, err := parseRedirect(to); err != nil {
+			logError(fmt.Sprintf("Invalid -redirect for %s: %s", from, err))
+			os.Exit(1)
+		}
+	}
+	if allowDelete && directory == "" {
+		logError("-allow-delete needs -directory") // rather than deleting relative to the working directory
+		os.Exit(1)
+	}
+	if directory != "" {
+		logInfo("Reading from directory:", directory)
+	}
+	router = newRouter()
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringList{"0.0.0.0:4221"}
+	}
+	srv := NewServer(listenAddrs)
+	srv.TLSAddrs = tlsAddrs
+	loadMaintenance()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			loadMaintenance()
+			if tlsConfig.Load() != nil {
+				if err := loadTLS(); err != nil {
+					logWarn("Keeping the old certificate:", err) // a half-written renewal shouldn't take HTTPS down
+				} else {
+					logInfo("Reloaded", tlsCert)
+				}
+			}
+		}
+	}()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		logInfo("Received", <-sig)
+		srv.Shutdown(drainTimeout)
+	}()
+	if err := srv.ListenAndServe(); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+}
+
+// defineFlags registers every command-line flag on fs, which also sets each
+// variable to its default, for tests that never parse a command line.
+func defineFlags(fs *flag.FlagSet) {
+	fs.StringVar(&directory, "directory", "", "The directory to read the file from")
+	fs.StringVar(&logLevelName, "log-level", "info", "The least severe messages logged to stderr: debug, info, warn or error")
+	fs.StringVar(&accessLog, "access-log", "common", "The format of the access log on stdout: \"common\" (Common Log Format plus the duration in ms), \"json\", or empty for none")
+	fs.BoolVar(&strict, "strict", false, "Reject requests that are malformed or missing required headers")
+	fs.BoolVar(&strictCRLF, "strict-crlf", false, "Reject requests whose lines end in a bare LF instead of CRLF")
+	fs.Var(fileRoutes, "file-route", "Serve a single file at a URL, as /url=/path/to/file (repeatable)")
+	fs.StringVar(&robots, "robots", "User-agent: *\nDisallow: /\n", "The policy served at /robots.txt, empty to disable")
+	fs.Var(redirects, "redirect", "Redirect a URL, as /old=/new or /old=CODE:/new with CODE one of 301, 302, 307, 308 (repeatable)")
+	fs.StringVar(&trailingSlash, "trailing-slash", "", "Redirect /files to /files/ (\"add\") or /files/ to /files (\"strip\"), empty to serve both")
+	fs.IntVar(&maxTargetLength, "max-target-length", 8000, "Reject request targets (path and query) longer than this with 414")
+	fs.StringVar(&charset, "charset", "utf-8", "The charset appended to text/* file Content-Types, empty to omit")
+	fs.BoolVar(&logErrorsVerbose, "log-errors-verbose", false, "Log the raw bytes of requests answered with a 4xx or 5xx")
+	fs.Var(extMap(mimeTypes), "mime-type", "Override the Content-Type for an extension, as .ext=type/subtype (repeatable)")
+	fs.StringVar(&notFoundMessage, "not-found-message", "", "The plain-text body of 404 responses")
+	fs.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "Give up on a client that accepts no response bytes for this long, 0 to wait forever")
+	fs.StringVar(&preloadFiles, "preload", "", "Comma-separated files under -directory to read into the in-memory cache at startup")
+	fs.BoolVar(&trustProxy, "trust-proxy", false, "Take the client address and scheme from Forwarded / X-Forwarded-* headers")
+	fs.DurationVar(&requestDeadline, "request-deadline", 0, "Close the connection if reading, handling and writing a request takes longer than this, 0 for no limit")
+	fs.StringVar(&cacheControl, "cache-control", "", "The Cache-Control header sent with file responses, e.g. \"public, max-age=3600\"")
+	fs.BoolVar(&empty204, "empty-204", false, "Answer 204 No Content instead of 200 OK when there's no body to send")
+	fs.IntVar(&workers, "workers", 256, "How many connections are handled at once")
+	fs.IntVar(&queueSize, "queue-size", 256, "How many accepted connections may wait for a worker before new ones get a 503")
+	fs.IntVar(&maxRequestsPerConn, "max-requests-per-conn", 100, "Close a persistent connection after serving this many requests, 0 for no limit")
+	fs.DurationVar(&idleTimeout, "idle-timeout", time.Minute, "Close a connection if the next request doesn't arrive in full within this long, 0 to wait forever")
+	fs.StringVar(&uploadTmpDir, "tmp-dir", "", "Where uploads are written before being renamed into -directory, defaults to the target's directory")
+	fs.BoolVar(&rejectGetBody, "reject-get-body", false, "Answer 400 to GET and HEAD requests that carry a body instead of discarding it")
+	fs.StringVar(&errorFormat, "error-format", "text", "The body format of error responses, \"text\" or \"json\"")
+	fs.Var(&listenAddrs, "listen", "An address to accept connections on, host:port or unix:/path/to/socket (repeatable, default 0.0.0.0:4221)")
+	fs.Var(&listenAddrs, "addr", "The same as -listen")
+	fs.Var(&tlsAddrs, "tls-addr", "An address to serve HTTPS on with -tls-cert, while the -listen ones stay plain HTTP (repeatable); without it, every address is HTTPS")
+	fs.IntVar(&maxIdleConns, "max-idle-conns", 0, "Close the least recently used idle connection once this many are waiting for a request, or when every worker is busy and another connection arrives; 0 for no limit")
+	fs.BoolVar(&enableMetrics, "metrics", false, "Serve counters and gauges in the Prometheus text format at /metrics")
+	fs.BoolVar(&cacheAge, "cache-age", false, "Send an Age header with files served from the in-memory cache")
+	fs.IntVar(&maxUploads, "max-uploads", 0, "Answer 503 to uploads beyond this many in progress at once, 0 for no limit")
+	fs.StringVar(&favicon, "favicon", "", "A file to serve at /favicon.ico, which otherwise answers 204 No Content")
+	fs.StringVar(&defaultEncoding, "default-encoding", "identity", "The encoding used for clients that send no Accept-Encoding, \"identity\" or \"gzip\"")
+	fs.IntVar(&retryAfter, "retry-after", 1, "The Retry-After seconds sent with 429 and 503 responses, 0 to omit")
+	fs.BoolVar(&allowDoubleEncoding, "allow-double-encoding", false, "Accept paths that still contain %XX escapes once decoded, e.g. from %252e")
+	fs.StringVar(&compressTypes, "compress-types", "text/*,application/json,application/javascript,image/svg+xml", "Comma-separated Content-Types eligible for gzip, where type/* covers every subtype")
+	fs.BoolVar(&precompressed, "precompressed", false, "Serve a file's .br or .gz sidecar, when there is one, to clients accepting that encoding")
+	fs.Float64Var(&rateLimit, "rate-limit", 0, "Answer 429 to a client sending more than this many requests per second to a route, 0 for no limit")
+	fs.Var(routeLimits, "route-rate-limit", "Override -rate-limit for one route, as METHOD /pattern=N with the pattern as registered, e.g. \"POST /files/*filename=1\" (repeatable)")
+	fs.DurationVar(&linger, "linger", 0, "After the last response, wait this long for the client to close before closing the connection, 0 to close at once")
+	fs.IntVar(&writeBufferSize, "write-buffer-size", 4096, "The size of each connection's response buffer, flushed after every response")
+	fs.StringVar(&dirListing, "dir-listing", "", "List directories under /files, as \"html\" or \"json\" by default (Accept: application/json always gets JSON), empty to answer 404")
+	fs.BoolVar(&shareFileHandles, "share-file-handles", false, "Let concurrent requests for the same file read through one open descriptor")
+	fs.IntVar(&uploadBufferSize, "upload-buffer-size", 32*1024, "The buffer size used to copy an upload's body to disk, at least 1024")
+	fs.BoolVar(&contentAddressed, "content-addressed", false, "Store uploads POSTed to /files itself under the SHA-256 of their content, returned in Location")
+	fs.Int64Var(&uploadQuota, "upload-quota", 0, "Answer 413 to uploads that would take a client past this many bytes per -upload-quota-window, 0 for no limit")
+	fs.DurationVar(&uploadQuotaWindow, "upload-quota-window", time.Hour, "The period -upload-quota applies to, starting with a client's first upload")
+	fs.IntVar(&maxRanges, "max-ranges", 100, "Answer 400 to a Range header listing more ranges than this, 0 for no limit")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "On SIGINT or SIGTERM, how long requests in progress get to finish before their connections are closed")
+	fs.BoolVar(&noKeepAlive, "no-keep-alive", false, "Close every connection after one request, with Connection: close")
+	fs.Int64Var(&uploadMemory, "upload-memory", 1<<20, "How much of an upload checked against Content-Digest is held in memory before the rest spills to a temp file")
+	fs.BoolVar(&connectTunnel, "connect-tunnel", false, "Answer CONNECT host:port by tunneling to it, making this an open proxy; otherwise CONNECT gets 405")
+	fs.IntVar(&maxChunks, "max-chunks", 65536, "Reject a chunked request body made of more chunks than this, 0 for no limit")
+	headerOrder.Set("Content-Type,Content-Length,Content-Encoding")
+	fs.Var(&headerOrder, "header-order", "Comma-separated header names sent first, in this order; the rest follow alphabetically")
+	fs.BoolVar(&maintenance, "maintenance", false, "Answer 503 to everything but /health")
+	fs.StringVar(&maintenanceFile, "maintenance-file", "", "A file whose presence turns on -maintenance, checked at startup and on SIGHUP")
+	fs.StringVar(&adminToken, "admin-token", "", "Enable POST /admin/flush-cache, for requests with \"Authorization: Bearer\" and this token")
+	fs.BoolVar(&allowDelete, "allow-delete", false, "Enable DELETE /files/{name}, which removes the file from -directory (required)")
+	fs.StringVar(&maintenanceMessage, "maintenance-message", "Down for maintenance\n", "The plain-text body of maintenance-mode 503 responses")
+	fs.StringVar(&tlsCert, "tls-cert", "", "A PEM certificate to serve HTTPS with, together with -tls-key; both are reread on SIGHUP")
+	fs.StringVar(&tlsKey, "tls-key", "", "The PEM private key for -tls-cert")
+	fs.BoolVar(&canonicalHeaders, "canonical-headers", false, "Send response header names in canonical MIME casing, e.g. Content-Type")
+	fs.Int64Var(&maxRequestBytes, "max-request-bytes", 0, "Answer 413 to a request whose request line, headers and body together exceed this many bytes, 0 for no limit")
+	fs.Int64Var(&maxBodySize, "max-body-size", 0, "Answer 413 to a request body longer than this many bytes, 0 for no limit")
+	fs.IntVar(&maxHeaderValue, "max-header-value", 4096, "Answer 431 to a request with a header value longer than this, repeated fields joined, 0 for no limit")
+	fs.DurationVar(&slowRequestThreshold, "slow-request-threshold", 0, "Log a warning for requests that take longer than this to handle and answer, 0 to never")
+	fs.BoolVar(&debugHeaders, "debug-headers", false, "Send X-Request-Header-Count, how many header fields the request had, with every response")
+}
+
+// stringList is a flag that collects every value it's given.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// handle serves every request on rwc until the connection ends. In production
+// rwc is a net.Conn; anything else, such as one end of an io.Pipe pair in a
+// test, is served without deadlines.
+func handle(rwc io.ReadWriteCloser) {
+	logDebug("Handling connection...")
+	con, ok := rwc.(net.Conn)
+	if !ok {
+		con = &rwConn{rwc}
+	}
+	if tc, ok := con.(*tls.Conn); ok {
+		if err := handshake(tc); err != nil {
+			logInfo("TLS handshake failed: ", err)
+			con.Close()
+			return
+		}
+	}
+	counted := &countingConn{Conn: con}
+	con = counted
+	defer func() {
+		closeGracefully(con)
+		logDebug(fmt.Sprintf("Connection from %s closed: read %d bytes, wrote %d bytes", con.RemoteAddr(), counted.read.Load(), counted.written.Load()))
+	}()
+
+	var src io.Reader = con
+	raw := &cappedBuffer{limit: maxLoggedRequestBytes}
+	if logErrorsVerbose {
+		src = io.TeeReader(con, raw)
+	}
+	reader := bufio.NewReader(src) // bytes past the end of one request stay buffered for the next
+	out := bufio.NewWriterSize(connWriter{con}, writeBufferSize)
+	ids := make(map[string]bool) // given out on this connection
+	for served := 1; ; served++ {
+		if !serveRequest(con, reader, out, raw, ids, maxRequestsPerConn > 0 && served >= maxRequestsPerConn) {
+			return
+		}
+	}
+}
+
+// rwConn adapts an io.ReadWriteCloser to the net.Conn the rest of the
+// connection handling uses. Deadlines are accepted and ignored.
+type rwConn struct{ io.ReadWriteCloser }
+
+func (*rwConn) LocalAddr() net.Addr              { return rwAddr{} }
+func (*rwConn) RemoteAddr() net.Addr             { return rwAddr{} }
+func (*rwConn) SetDeadline(time.Time) error      { return nil }
+func (*rwConn) SetReadDeadline(time.Time) error  { return nil }
+func (*rwConn) SetWriteDeadline(time.Time) error { return nil }
+
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "rw" }
+func (rwAddr) String() string  { return "rw" }
+
+// countingConn counts the bytes read from and written to a connection over
+// its lifetime, across every request it carries.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite passes through to the underlying connection, which embedding
+// alone would hide from closeGracefully.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
 }
 
-func handle(con net.Conn) {
-	fmt.Println("Handling connection...")
+// recordingConn is the connection as handlers see it. It notes the head and
+// size of a response a handler writes itself, for the access log.
+type recordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex // a CONNECT tunnel writes from another goroutine
+	head    []byte     // as much of the head as has been written, up to maxRecordedHead
+	written int64
+}
+
+// maxRecordedHead is how much of a handler's response head recordingConn
+// keeps, enough for the status line.
+const maxRecordedHead = 1024
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written += int64(n)
+	if room := maxRecordedHead - len(c.head); room > 0 {
+		c.head = append(c.head, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// response returns the status code of what was written, 0 if nothing was,
+// and the bytes written after the head.
+func (c *recordingConn) response() (status int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := string(c.head)
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		return statusCode(head), c.written - int64(i+4)
+	}
+	return statusCode(head), 0
+}
+
+// maxLingerBytes caps how much a client can send while a closing connection
+// lingers, so it can't keep the worker busy until -linger runs out.
+const maxLingerBytes = 64 << 10
+
+// closeGracefully closes con once the last response is written. Closing a
+// socket that still has unread input makes the kernel answer with a reset,
+// which can destroy response bytes the client hasn't read yet, so it first
+// half-closes, letting the response and a FIN drain, and reads until the client
+// closes its side or -linger passes.
+func closeGracefully(con net.Conn) {
 	defer con.Close()
+	cw, ok := con.(interface{ CloseWrite() error })
+	if !ok || linger <= 0 || cw.CloseWrite() != nil {
+		return // nothing to wait for, or con is already gone
+	}
+	con.SetReadDeadline(time.Now().Add(linger))
+	io.Copy(io.Discard, io.LimitReader(con, maxLingerBytes))
+}
 
-	data := make([]byte, 0)
-	buffer := make([]byte, 1024) // buffer is the byte arr of the req, max length of req is 1024 bytes
-	n, err := con.Read(buffer)   // also blocking, this reads the request
-	if err != nil && err != io.EOF {
-		fmt.Println("Error reading:", err)
-		return
-	}
-	data = append(data, buffer[:n]...)
-
-	path := strings.Split(string(data), " ")[1]
-	method, headers, body := parseRequest(string(data))
-	fmt.Println("Method:", method)
-	fmt.Println("Headers:", headers)
-	fmt.Println("Body:", body)
-
-	var response string
-
-	switch {
-	case path == "/":
-		response = createResponse("200 OK", nil, "")
-	case strings.HasPrefix(path, "/echo"):
-		response = echo(strings.TrimPrefix(path, "/echo/"), headers["accept-encoding"])
-	case strings.HasPrefix(path, "/user-agent"):
-		response = returnUserAgent(headers["user-agent"])
-	case strings.HasPrefix(path, "/files"):
-		if method == "GET" {
-			response = returnFileIfExists(strings.TrimPrefix(path, "/files/"))
-		} else if method == "POST" {
-			response = createFile(strings.TrimPrefix(path, "/files/"), []byte(body))
-		}
-	default:
-		response = createResponse("404 Not Found", nil, "")
-	}
-
-	_, err = con.Write([]byte(response))
+// serveRequest reads and answers one request on con, reporting whether the
+// connection should stay open for another. When last is set the response
+// carries Connection: close regardless of what the client asked for. ids holds
+// the request IDs already given out on the connection.
+func serveRequest(con net.Conn, reader *bufio.Reader, out *bufio.Writer, raw *cappedBuffer, ids map[string]bool, last bool) bool {
+	raw.reset()
+	if idleTimeout > 0 {
+		con.SetReadDeadline(time.Now().Add(idleTimeout)) // so an idle persistent connection doesn't hold a worker forever
+	}
+	idle.add(con)
+	_, err := reader.Peek(1)
+	idle.remove(con)
+	if err != nil {
+		return false // the client hung up, went idle too long or was evicted
+	}
+	if requestDeadline > 0 {
+		// A backstop over every stage at once: closing the connection unblocks
+		// any read or write in progress, whichever stage is running long. It
+		// starts with the request's first byte, so idling between requests
+		// is left to -idle-timeout.
+		timer := time.AfterFunc(requestDeadline, func() {
+			logInfo("Request deadline exceeded, closing connection")
+			con.Close()
+		})
+		defer timer.Stop()
+	}
+	start := time.Now()
+	req, err := readRequest(reader, con)
 	if err != nil {
-		fmt.Println("Error writing: ", err)
+		logInfo("Error parsing request:", err)
+		status := "400 Bad Request"
+		var se *statusError
+		if errors.As(err, &se) {
+			status = se.status
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			status = "408 Request Timeout"
+		}
+		// The stream can't be trusted past a bad request, so this is the last one.
+		id := newRequestID()
+		response := createResponse(status, map[string]string{"Connection": "close", "X-Request-Id": id}, "")
+		err = flushResponse(out, response)
+		if err != nil {
+			logDebug("Error writing: ", err)
+		}
+		remote := clientIP(&Request{RemoteAddr: con.RemoteAddr().String()}) // the same as for requests that parse, minus the headers
+		logAccess(accessEntry{Time: start, Remote: remote, Status: statusCode(response), Bytes: bodySize(response),
+			Duration: milliseconds(time.Since(start)), ID: id})
+		if logErrorsVerbose {
+			logRawRequest(status[:3], raw)
+		}
+		return false
 	}
+	req.RemoteAddr = con.RemoteAddr().String()
+	rec := &recordingConn{Conn: con}
+	req.conn, req.reader = rec, reader
+	req.ID = requestID(req, ids)
+	logDebug("Request ID:", req.ID)
+	logDebug("Client:", clientIP(req), requestScheme(req))
+	logDebug("Method:", req.Method)
+	logDebug("Version:", req.Version) // to spot HTTP/1.0 clients
+	logDebug("Headers:", req.Headers)
+	logDebug("Content-Length:", req.ContentLength)
+	entry := accessEntry{Time: start, Remote: clientIP(req), Method: req.Method, Target: req.Target, Version: req.Version, ID: req.ID}
+	defer func() {
+		entry.Duration = milliseconds(time.Since(start))
+		logAccess(entry) // however the request ended
+	}()
 
-	fmt.Println("Response sent: ", response)
+	if slowRequestThreshold > 0 {
+		defer logIfSlow(req, time.Now())
+	}
+	response := route(req)
+	if response == "" {
+		entry.Status, entry.Bytes = rec.response()
+		return false // streamed straight to con, which ends the connection
+	}
+	if req.response != nil && req.response.done != nil {
+		defer req.response.done()
+	}
+	// A refusal that didn't need the body goes out without waiting for it,
+	// which means closing: reading it all just to skip it would hold the
+	// client to uploading something already turned down.
+	refused := !req.bodyRead && statusCode(response) >= 400 && !bodyBuffered(req)
+	var drainErr error
+	if !refused {
+		// Skip past whatever body the handler didn't read; if that fails the
+		// next request can't be found, so this has to be the last.
+		_, drainErr = io.Copy(io.Discard, req.rawBody)
+	}
+	if errors.Is(drainErr, errRequestTooLarge) {
+		// Caught only now for a chunked body the handler left unread, so
+		// its response stands for a request that was never allowed.
+		response = createResponse("413 Content Too Large", nil, "")
+		req.response = nil
+	}
+	keepAlive := !last && !noKeepAlive && !wantsClose(req) && drainErr == nil && !refused && !req.desync && !draining.Load()
+	response = addHeader(response, "X-Request-Id", req.ID)
+	if debugHeaders {
+		response = addHeader(response, "X-Request-Header-Count", strconv.Itoa(req.headerCount)) // shows what a proxy added or stripped
+	}
+	if keepAlive {
+		response = addHeader(response, "Connection", "keep-alive")
+		if req.Version == "HTTP/1.0" && idleTimeout > 0 {
+			// An HTTP/1.0 client that opted in can't assume persistence
+			// the way an HTTP/1.1 one does, so it's told how long the
+			// connection stays open for its next request.
+			response = addHeader(response, "Keep-Alive", fmt.Sprintf("timeout=%d", int(idleTimeout.Seconds())))
+		}
+	} else {
+		response = addHeader(response, "Connection", "close")
+	}
+	if req.Method == "HEAD" {
+		response = withoutBody(response)
+		req.response = nil
+	}
+	head, _, _ := strings.Cut(response, "\r\n\r\n")
+	entry.Status, entry.Bytes = statusCode(response), bodySize(response)
+	if req.response != nil {
+		// The head goes out with the start of the body rather than on its own.
+		if _, err := out.WriteString(response); err != nil {
+			logDebug("Error writing: ", err)
+			return false
+		}
+		if err := sendBody(out, req.response); err != nil {
+			logInfo("Error streaming body: ", err)
+			// What was read still goes out, then the connection closes
+			// short of Content-Length, which tells the client the body
+			// is incomplete.
+			out.Flush()
+			return false
+		}
+		entry.Bytes = req.response.ContentLength
+		response = ""
+	}
+	err = flushResponse(out, response)
+	if err != nil {
+		logDebug("Error writing: ", err)
+		return false
+	}
+
+	logDebug("Response sent: ", head) // the body may well be binary
+	if logErrorsVerbose && entry.Status >= 400 {
+		logRawRequest(strconv.Itoa(entry.Status), raw)
+	}
+	return keepAlive
+}
+
+// bodyBuffered reports whether all of req's body has already arrived, so
+// skipping it costs the client nothing. A chunked body's end can't be known
+// without reading it.
+func bodyBuffered(req *Request) bool {
+	return req.ContentLength == 0 || req.ContentLength > 0 && int64(req.reader.Buffered()) >= req.ContentLength
+}
+
+// logIfSlow logs req if handling it and writing the response took longer than
+// -slow-request-threshold.
+func logIfSlow(req *Request, start time.Time) {
+	if took := time.Since(start); took > slowRequestThreshold {
+		logWarn(fmt.Sprintf("Slow request: %s %s from %s took %s (threshold %s)", req.Method, req.Target, clientIP(req), took.Round(time.Millisecond), slowRequestThreshold))
+	}
 }
 
-func parseRequest(s string) (string, map[string]string, string) {
-	headers := make(map[string]string)
+// maxUsedIDs bounds how many request IDs a connection remembers. Only the
+// requests in flight at once need telling apart.
+const maxUsedIDs = 1024
 
-	parts := strings.SplitN(s, "\r\n\r\n", 2)
-	lines := strings.Split(parts[0], "\n")
-	method := strings.Split(lines[0], " ")[0]
-	for _, line := range lines[1:] { // skip the first line (request line)
-		line = strings.TrimSpace(line)
-		if line == "" {
-			break // last line, done with headers
+// requestID returns the X-Request-Id the request came with, if it's a sane
+// one, so an ID assigned upstream carries through; otherwise a new random one.
+// used holds the IDs already given out on the connection, and a repeat gets a
+// new one too, so pipelined responses can always be told apart.
+func requestID(req *Request, used map[string]bool) string {
+	id := req.Headers["x-request-id"]
+	if id == "" || len(id) > 128 || !validToken(id) || used[id] {
+		id = newRequestID()
+	}
+	if len(used) >= maxUsedIDs {
+		clear(used)
+	}
+	used[id] = true
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// wantsClose reports whether the client asked for the connection to end after
+// this request. HTTP/1.0 clients have to opt in to persistence.
+func wantsClose(req *Request) bool {
+	tokens := strings.Split(strings.ToLower(req.Headers["connection"]), ",")
+	for i := range tokens {
+		tokens[i] = strings.TrimSpace(tokens[i])
+	}
+	if slices.Contains(tokens, "close") {
+		return true
+	}
+	return req.Version == "HTTP/1.0" && !slices.Contains(tokens, "keep-alive")
+}
+
+// route answers req, or returns "" if the handler streamed its response straight
+// to the connection.
+func route(req *Request) string {
+	if inMaintenance.Load() && req.Path != "/health" {
+		return maintenanceResponse()
+	}
+	if req.Method == "CONNECT" {
+		return connect(req)
+	}
+	if req.Method == "OPTIONS" {
+		return options(req.Path)
+	}
+	fn, params, allowed := router.Match(req.Method, req.Path)
+	if fn == nil && allowed != nil {
+		return createResponse("405 Method Not Allowed", map[string]string{"Allow": strings.Join(allowed, ", ")}, "")
+	}
+	if fn == nil {
+		return notFound()
+	}
+	return fn(req, params)
+}
+
+var router *Router
+
+// newRouter registers every endpoint. It runs after flag parsing, since which
+// routes exist depends on the flags; earlier registrations take precedence.
+func newRouter() *Router {
+	r := &Router{}
+	switch trailingSlash {
+	case "add":
+		r.Handle("GET", "/files", func(*Request, map[string]string) string { return redirect(301, "/files/") })
+	case "strip":
+		r.Handle("GET", "/files/", func(*Request, map[string]string) string { return redirect(301, "/files") })
+		r.Handle("GET", "/files", func(req *Request, _ map[string]string) string { return returnFileIfExists("", req) })
+	}
+	for from, to := range redirects {
+		code, location, _ := parseRedirect(to) // validated at startup
+		for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE"} {
+			r.Handle(method, from, func(*Request, map[string]string) string { return redirect(code, location) })
 		}
-		split := strings.SplitN(line, ":", 2)
-		if len(split) == 2 {
-			k := strings.TrimSpace(strings.ToLower(split[0]))
-			v := strings.TrimSpace(split[1])
-			headers[k] = v
+	}
+	for url, file := range fileRoutes {
+		r.Handle("GET", url, func(req *Request, _ map[string]string) string { return serveFile(file, req) })
+	}
+	if robots != "" {
+		r.Handle("GET", "/robots.txt", func(*Request, map[string]string) string { return textResponse(robots) })
+	}
+	r.Handle("GET", "/favicon.ico", func(req *Request, _ map[string]string) string {
+		if favicon != "" {
+			return serveFile(favicon, req)
 		}
+		return createResponse("204 No Content", nil, "") // browsers ask regardless, keep it out of the 404s
+	})
+	if enableMetrics {
+		r.Handle("GET", "/metrics", func(*Request, map[string]string) string { return textResponse(metrics.render()) })
 	}
-	if len(parts) > 1 {
-		return method, headers, parts[1]
+	if adminToken != "" {
+		r.Handle("POST", "/admin/flush-cache", admin(func(*Request, map[string]string) string {
+			logInfo("Flushed", cache.flush(), "cached files")
+			return createResponse("204 No Content", nil, "")
+		}))
 	}
-	return method, headers, ""
+	r.Handle("GET", "/", func(*Request, map[string]string) string { return createResponse("200 OK", nil, "") })
+	r.Handle("GET", "/health", func(*Request, map[string]string) string { return textResponse("ok") })
+	r.Handle("GET", "/echo", func(req *Request, _ map[string]string) string {
+		return echo("", acceptEncoding(req.Headers)) // treated like "/echo/"
+	})
+	r.Handle("GET", "/echo/*text", func(req *Request, params map[string]string) string {
+		return echo(params["text"], acceptEncoding(req.Headers))
+	})
+	r.Handle("GET", "/drip", func(req *Request, _ map[string]string) string {
+		if err := drip(req.conn, req); err != nil {
+			logDebug("Error dripping: ", err)
+		}
+		return "" // drip writes its own response as it goes
+	})
+	r.Handle("GET", "/events", func(req *Request, _ map[string]string) string {
+		if err := events(req); err != nil {
+			logDebug("Error streaming events: ", err)
+		}
+		return "" // events writes its own response as it goes
+	})
+	for _, method := range knownMethods {
+		r.Handle(method, "/method", func(req *Request, _ map[string]string) string {
+			return textResponse(req.Method) // handy for checking what a proxy passes through
+		})
+	}
+	r.Handle("GET", "/bytes/:count", func(_ *Request, params map[string]string) string {
+		return randomBytes(params["count"])
+	})
+	r.Handle("GET", "/user-agent", func(req *Request, _ map[string]string) string {
+		ua, ok := req.Headers["user-agent"]
+		if !ok && strict {
+			return createResponse("400 Bad Request", nil, "")
+		}
+		return returnUserAgent(ua, req.Headers["accept"], acceptEncoding(req.Headers)) // lenient: absent is treated like empty
+	})
+	r.Handle("GET", "/files/*filename", func(req *Request, params map[string]string) string {
+		return returnFileIfExists(params["filename"], req)
+	})
+	if contentAddressed {
+		for _, pattern := range []string{"/files", "/files/"} {
+			r.Handle("POST", pattern, func(req *Request, _ map[string]string) string {
+				body, ok := withQuota(req)
+				if !ok {
+					return createResponse("413 Content Too Large", nil, "")
+				}
+				return createAddressed(body)
+			})
+		}
+	}
+	r.Handle("POST", "/files/*filename", func(req *Request, params map[string]string) string {
+		body, ok := withQuota(req)
+		if !ok {
+			return createResponse("413 Content Too Large", nil, "") // before reading any of it
+		}
+		release, ok := takeUploadSlot()
+		if !ok {
+			logWarn("Too many uploads in progress, rejecting: ", params["filename"])
+			return createResponse("503 Service Unavailable", nil, "")
+		}
+		defer release() // from before Content-Digest verification, which reads the whole body too
+		if cd, ok := req.Headers["content-digest"]; ok {
+			buf, err := verifiedBody(body, cd)
+			if err != nil {
+				logInfo("Rejecting upload: ", err)
+				return uploadFailed(err)
+			}
+			if buf != nil {
+				defer buf.Close()
+				if body, err = buf.reader(); err != nil {
+					return createResponse("500 Internal Server Error", nil, "")
+				}
+			}
+		}
+		return createFile(params["filename"], body)
+	})
+	if allowDelete && directory != "" {
+		r.Handle("DELETE", "/files/*filename", func(_ *Request, params map[string]string) string {
+			return deleteFile(params["filename"])
+		})
+	}
+	return r
+}
+
+// addHeader inserts a header into a serialized response, re-sorting the head
+// so the new field lands where -header-order puts it.
+func addHeader(response string, k, v string) string {
+	head, body, _ := strings.Cut(response, "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	fields := make(headerList, 0, len(lines))
+	for _, line := range lines[1:] { // after the status line
+		name, value, _ := strings.Cut(line, ": ")
+		fields = append(fields, header{name, value})
+	}
+	fields = append(fields, header{k, v})
+	fields.sort()
+	return lines[0] + "\r\n" + fields.String() + "\r\n" + body
+}
+
+// flushResponse writes response through out and flushes it, so nothing is left
+// sitting in the buffer while the client waits to send its next request. An
+// error means the connection is unusable and has to close.
+func flushResponse(out *bufio.Writer, response string) error {
+	if _, err := out.WriteString(response); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// connWriter sends what a bufio.Writer flushes through writeAll, keeping the
+// per-chunk write deadlines.
+type connWriter struct{ con net.Conn }
+
+func (w connWriter) Write(p []byte) (int, error) {
+	if err := writeAll(w.con, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeChunkSize is how much writeAll hands the socket per deadline.
+const writeChunkSize = 32 * 1024
+
+// writeAll writes data in chunks, pushing the write deadline out before each
+// one, so a client that keeps reading is never cut off but one that stalls
+// errors out after -write-timeout instead of blocking the goroutine forever.
+func writeAll(con net.Conn, data []byte) error {
+	for len(data) > 0 {
+		if writeTimeout > 0 {
+			if err := con.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				return err
+			}
+		}
+		n, err := con.Write(data[:min(len(data), writeChunkSize)])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// maxLoggedRequestBytes caps how much of a request -log-errors-verbose keeps.
+const maxLoggedRequestBytes = 4096
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops
+// the rest, so it never fails the write it's teed from.
+type cappedBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	room := c.limit - len(c.buf)
+	if len(p) > room {
+		c.truncated = true
+		p = p[:max(room, 0)]
+	}
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+func (c *cappedBuffer) reset() {
+	c.buf = c.buf[:0]
+	c.truncated = false
+}
+
+func logRawRequest(status string, raw *cappedBuffer) {
+	suffix := ""
+	if raw.truncated {
+		suffix = fmt.Sprintf(" (truncated to %d bytes)", raw.limit)
+	}
+	logError(fmt.Sprintf("Error response %s for request%s: %q", status, suffix, raw.buf))
+}
+
+// pathMap is a repeatable flag of "key=value" pairs, keyed by URL path.
+type pathMap map[string]string
+
+func (m pathMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m pathMap) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(k, "/") || v == "" {
+		return fmt.Errorf("expected /path=value, got %q", s)
+	}
+	m[k] = v
+	return nil
+}
+
+func options(path string) string {
+	allowed := router.Allowed(path)
+	if allowed == nil {
+		return notFound() // no such resource, as opposed to 204 + Allow
+	}
+	headers := map[string]string{"Allow": strings.Join(allowed, ", ")}
+	if servesFile(path) {
+		headers["Accept-Ranges"] = "bytes" // the same as a GET would advertise
+	}
+	return createResponse("204 No Content", headers, "")
+}
+
+// servesFile reports whether GET path is answered by serveFile, which honors
+// Range.
+func servesFile(path string) bool {
+	return strings.HasPrefix(path, "/files/") || fileRoutes[path] != "" || path == "/favicon.ico" && favicon != ""
 }
 
 func createResponse(status string, headers map[string]string, body string) string {
-	resp := "HTTP/1.1 " + status + "\r\n"
+	if empty204 && status == "200 OK" && body == "" && (headers["Content-Length"] == "" || headers["Content-Length"] == "0") {
+		status = "204 No Content"
+	}
+	if (status[:3] == "429" || status[:3] == "503") && retryAfter > 0 && headers["Retry-After"] == "" {
+		withRetry := map[string]string{"Retry-After": strconv.Itoa(retryAfter)}
+		for k, v := range headers {
+			withRetry[k] = v
+		}
+		headers = withRetry // copied, since callers may share their maps
+	}
+	if errorFormat == "json" && status >= "400" && body == "" && headers["Content-Length"] == "" {
+		return errorResponse(status, headers, "") // every error gets a structured body, not just the ones built by errorResponse
+	}
+	bodyless := !bodyAllowed(status)
+	fields := make(headerList, 0, len(headers)+1)
 	for k, v := range headers {
-		resp += k + ": " + v + "\r\n"
+		if k != "Content-Length" {
+			fields = append(fields, header{k, v})
+		}
+	}
+	if !bodyless {
+		length, sized := headers["Content-Length"]
+		if !sized {
+			length = strconv.Itoa(len(body)) // keeps message boundaries clear, even for empty bodies
+		}
+		fields = append(fields, header{"Content-Length", length})
+	}
+	fields.sort()
+	resp := "HTTP/1.1 " + status + "\r\n" + fields.String()
+	if bodyless {
+		return resp + "\r\n" // whatever body the caller passed is dropped
 	}
 	resp += "\r\n"
 	resp += body
 	return resp
 }
 
-func echo(s string, encoding string) string {
-	encoding = strings.TrimSpace(strings.ReplaceAll(encoding, " ", ""))
-	encodings := strings.Split(encoding, ",")
+// bodyAllowed reports whether a response with this status may carry a body;
+// 1xx, 204 and 304 responses end with their headers.
+func bodyAllowed(status string) bool {
+	return !strings.HasPrefix(status, "1") && !strings.HasPrefix(status, "204") && !strings.HasPrefix(status, "304")
+}
+
+func notFound() string {
+	return errorResponse("404 Not Found", nil, notFoundMessage)
+}
 
-	headers := map[string]string{
-		"Content-Type": "text/plain",
+// errorResponse builds an error response in the -error-format: a plain-text
+// message (or no body if message is empty), or a JSON object holding the
+// message, defaulting to the status text, and the numeric status.
+func errorResponse(status string, headers map[string]string, message string) string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if errorFormat == "json" {
+		code, text, _ := strings.Cut(status, " ")
+		if message == "" {
+			message = text
+		}
+		n, _ := strconv.Atoi(code)
+		body, _ := json.Marshal(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{message, n})
+		headers["Content-Type"] = "application/json"
+		return createResponse(status, headers, string(body))
+	}
+	if message == "" {
+		return createResponse(status, headers, "")
 	}
+	headers["Content-Type"] = "text/plain"
+	return createResponse(status, headers, message)
+}
 
-	var body string
-	if slices.Contains(encodings, "gzip") {
-		headers["Content-Encoding"] = "gzip"
-		compressedData, err := compressGzip([]byte(s))
-		if err != nil {
-			body = s // Fallback to uncompressed data
-		} else {
-			body = string(compressedData) // use compressed data without base64 encoding
+// withoutBody cuts a serialized response down to its status line and headers,
+// which are left exactly as GET would send them.
+func withoutBody(response string) string {
+	head, _, _ := strings.Cut(response, "\r\n\r\n")
+	return head + "\r\n\r\n"
+}
+
+var redirectStatus = map[int]string{
+	301: "301 Moved Permanently",
+	302: "302 Found",
+	307: "307 Temporary Redirect", // 307 and 308 oblige the client to repeat the same method
+	308: "308 Permanent Redirect",
+}
+
+// parseRedirect splits a -redirect value of the form "/new" or "CODE:/new".
+func parseRedirect(s string) (int, string, error) {
+	code, location := 301, s
+	if len(s) > 4 && s[3] == ':' {
+		n, err := strconv.Atoi(s[:3])
+		if err == nil {
+			code, location = n, s[4:]
 		}
-	} else {
-		body = s
 	}
+	if _, ok := redirectStatus[code]; !ok {
+		return 0, "", fmt.Errorf("unsupported redirect status %d", code)
+	}
+	if location == "" {
+		return 0, "", fmt.Errorf("missing redirect location")
+	}
+	return code, location, nil
+}
 
-	headers["Content-Length"] = strconv.Itoa(len(body))
-	return createResponse("200 OK", headers, body)
+func redirect(code int, location string) string {
+	headers := map[string]string{"Location": location}
+	return createResponse(redirectStatus[code], headers, "")
 }
 
+func textResponse(body string) string {
+	return createResponse("200 OK", map[string]string{"Content-Type": "text/plain"}, body)
+}
+
+func echo(s string, encoding string) string {
+	w := newResponseBuffer("200 OK", "text/plain")
+	w.acceptEncoding = encoding
+	w.WriteString(s)
+	return w.close()
+}
+
+// acceptEncoding is the client's Accept-Encoding, or when it sent none,
+// whatever -default-encoding says to assume.
+func acceptEncoding(headers map[string]string) string {
+	if ae, ok := headers["accept-encoding"]; ok {
+		return ae // an empty value still means identity only
+	}
+	return defaultEncoding
+}
+
+// compressBody gzips body if the Accept-Encoding value allows it. It only sets
+// Content-Encoding once compression has succeeded, so a failure falls back to
+// the plain body with no encoding claimed, and a Warning saying so. Callers set
+// Content-Length from the returned body.
+func compressBody(body string, acceptEncoding string, headers map[string]string) string {
+	if !compressible(headers["Content-Type"]) {
+		return body // likely compressed already, gzip would only cost CPU
+	}
+	if !acceptsGzip(acceptEncoding) {
+		return body
+	}
+	compressedData, err := compress([]byte(body))
+	if err != nil {
+		logError("Error compressing body, sending it uncompressed: ", err)
+		headers["Warning"] = `199 - "gzip failed, sent uncompressed"` // the client asked for gzip and didn't get it
+		return body
+	}
+	headers["Content-Encoding"] = "gzip"
+	return string(compressedData) // use compressed data without base64 encoding
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	acceptEncoding = strings.TrimSpace(strings.ReplaceAll(acceptEncoding, " ", ""))
+	return slices.Contains(strings.Split(acceptEncoding, ","), "gzip")
+}
+
+// compressible reports whether contentType matches -compress-types, where an
+// entry like text/* covers every subtype.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, allowed := range strings.Split(compressTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") || allowed == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// compress is compressGzip, unless a test needs it to fail.
+var compress = compressGzip
+
 func compressGzip(data []byte) ([]byte, error) {
 	var b bytes.Buffer
 	w, err := gzip.NewWriterLevel(&b, gzip.BestCompression)
@@ -167,41 +1102,132 @@ func compressGzip(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func returnUserAgent(ua string) string {
-	headers := map[string]string{"Content-Type": "text/plain",
-		"Content-Length": strconv.Itoa(utf8.RuneCountInString(ua))}
-	return createResponse("200 OK", headers, ua)
+// maxRandomBytes caps what a single /bytes/{n} request can ask for.
+const maxRandomBytes = 1 << 20
+
+func randomBytes(count string) string {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 || n > maxRandomBytes {
+		return createResponse("400 Bad Request", nil, "")
+	}
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return createResponse("500 Internal Server Error", nil, "")
+	}
+	return createResponse("200 OK", map[string]string{"Content-Type": "application/octet-stream"}, string(data))
 }
 
-func returnFileIfExists(file string) string {
-	fullFile := filepath.Join(directory, file)
-	data, err := os.ReadFile(fullFile)
+// Bounds on /drip so one request can't hold a connection open indefinitely.
+const (
+	maxDripBytes    = 10 * 1024
+	maxDripDuration = time.Minute
+)
+
+// drip streams ?bytes= bytes (default 10) spread evenly over ?duration=
+// seconds (default 2) as a chunked response, one byte per chunk. HTTP/1.0
+// clients don't know chunked encoding, so they get raw bytes and the end of
+// the body is signalled by closing the connection.
+func drip(con net.Conn, req *Request) error {
+	query, err := url.ParseQuery(req.Query)
 	if err != nil {
-		fmt.Println("File does not exist: ", file)
-		return createResponse("404 Not Found", nil, "")
-	} else {
-		fmt.Println("File found: ", file)
-		headers := map[string]string{"Content-Type": "application/octet-stream",
-			"Content-Length": strconv.Itoa(utf8.RuneCountInString(string(data)))}
-		return createResponse("200 OK", headers, string(data))
+		return writeStatus(req, "400 Bad Request")
+	}
+	n, duration := 10, 2*time.Second
+	if v := query.Get("bytes"); v != "" {
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDripBytes {
+			return writeStatus(req, "400 Bad Request")
+		}
+	}
+	if v := query.Get("duration"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		duration = time.Duration(seconds * float64(time.Second))
+		if err != nil || duration < 0 || duration > maxDripDuration {
+			return writeStatus(req, "400 Bad Request")
+		}
+	}
+
+	chunked := req.Version != "HTTP/1.0"
+	trailers := chunked && acceptsTrailers(req)
+	head := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nConnection: close\r\nX-Request-Id: " + req.ID + "\r\n"
+	if chunked {
+		head += "Transfer-Encoding: chunked\r\n"
+	}
+	if trailers {
+		head += "Trailer: X-Drip-Duration\r\n"
+	}
+	if err := writeAll(con, []byte(head+"\r\n")); err != nil {
+		return err
+	}
+	if req.Method == "HEAD" {
+		return nil // the same head a GET would get, and no body
+	}
+	start := time.Now()
+	chunk := []byte("*")
+	if chunked {
+		chunk = []byte("1\r\n*\r\n")
+	}
+	var interval time.Duration
+	if n > 0 {
+		interval = duration / time.Duration(n)
+	}
+	for i := 0; i < n; i++ {
+		time.Sleep(interval)
+		if err := writeAll(con, chunk); err != nil {
+			return err
+		}
+	}
+	if !chunked {
+		return nil // the caller closing con ends the body
 	}
+	if trailers {
+		// Only known once the body is out, which is what trailers are for.
+		return writeAll(con, []byte(fmt.Sprintf("0\r\nX-Drip-Duration: %.3f\r\n\r\n", time.Since(start).Seconds())))
+	}
+	return writeAll(con, []byte("0\r\n\r\n"))
 }
 
-func createFile(file string, body []byte) string {
-	fmt.Println("CREATING FILE!")
-	fullFile := filepath.Join(directory, file)
-	f, err := os.Create(fullFile)
-	if err != nil {
-		fmt.Println("Error creating file: ", file, err.Error())
-		return createResponse("400 Bad Request", nil, "")
-	} else {
-		fmt.Printf("Created file: %s\n", file)
-		n, err := f.Write(body)
-		if err != nil {
-			return createResponse("400 Bad Request", nil, "")
-		} else {
-			fmt.Printf("Wrote %d bytes\n", n)
-			return createResponse("201 Created", nil, "")
+// writeStatus answers req with an empty response straight to its connection,
+// for handlers that write their own and so skip what serveRequest adds.
+func writeStatus(req *Request, status string) error {
+	headers := map[string]string{"Connection": "close", "X-Request-Id": req.ID}
+	return writeAll(req.conn, []byte(createResponse(status, headers, "")))
+}
+
+// acceptsTrailers reports whether req's TE header lists "trailers", without
+// which a client may not be expecting fields after a chunked body.
+func acceptsTrailers(req *Request) bool {
+	for _, member := range strings.Split(req.Headers["te"], ",") {
+		coding, _, _ := strings.Cut(member, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+func returnUserAgent(ua string, accept string, acceptEncoding string) string {
+	w := newResponseBuffer("200 OK", "text/plain")
+	w.acceptEncoding = acceptEncoding
+	if acceptsJSON(accept) {
+		if data, err := json.Marshal(map[string]string{"user-agent": ua}); err == nil {
+			w.headers["Content-Type"] = "application/json"
+			w.Write(data)
+			return w.close()
+		}
+	}
+	w.WriteString(ua)
+	return w.close()
+}
+
+// acceptsJSON reports whether the Accept header lists application/json, ignoring
+// any parameters such as q-values.
+func acceptsJSON(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		if strings.EqualFold(mediaType, "application/json") {
+			return true
 		}
 	}
+	return false
 }
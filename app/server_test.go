@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleOverPipe(t *testing.T) {
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	for _, path := range []string{"/", "/echo/abc"} {
+		if _, err := io.WriteString(c, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != 200 || resp.Close {
+			t.Errorf("GET %s: status %d, close %v, want 200 on a kept-alive connection", path, resp.StatusCode, resp.Close)
+		}
+	}
+}
+
+// rwPair is an io.ReadWriteCloser that isn't a net.Conn.
+type rwPair struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (p *rwPair) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p *rwPair) Write(b []byte) (int, error) { return p.out.Write(b) }
+func (*rwPair) Close() error                  { return nil }
+
+func TestHandleReadWriteCloser(t *testing.T) {
+	rw := &rwPair{in: strings.NewReader(request("GET", "/echo/hi", nil))}
+	handle(rw)
+	resps := parseResponses(t, rw.out.String(), "GET")
+	if len(resps) != 1 || resps[0].StatusCode != 200 || resps[0].body != "hi" {
+		t.Fatalf("got %+v, want one 200 with body hi", resps)
+	}
+}
+
+// TestLingerDeliversWholeResponse closes a connection that still has unread
+// input, which without -linger makes the kernel answer with a reset, dropping
+// whatever of the response is still in the send buffer.
+func TestLingerDeliversWholeResponse(t *testing.T) {
+	set(t, &linger, time.Second)
+	dir := withDir(t)
+	const size = 16 << 20 // more than the socket buffers hold, so the server closes while some is unsent
+	if err := os.WriteFile(filepath.Join(dir, "big"), make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, request("GET", "/files/big", nil)+strings.Repeat("x", 30000)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond) // let the server fill the buffers before anything is read
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != size {
+		t.Fatalf("read %d of %d bytes: %v", n, size, err)
+	}
+}
+
+// TestCloseAfterWriteDeliversWholeResponse has the server close right after
+// its last response, with no linger: everything buffered is flushed first.
+func TestCloseAfterWriteDeliversWholeResponse(t *testing.T) {
+	resp, body := do(t, request("GET", "/bytes/100000", nil))
+	if resp.StatusCode != 200 || len(body) != 100000 {
+		t.Fatalf("status %d with %d bytes, want 200 with 100000", resp.StatusCode, len(body))
+	}
+}
+
+func TestSlowRequestLogged(t *testing.T) {
+	set(t, &slowRequestThreshold, 20*time.Millisecond)
+	log := captureLog(t, levelWarn)
+	withRouter(t)
+	router.Handle("GET", "/slow", func(*Request, map[string]string) string {
+		time.Sleep(50 * time.Millisecond)
+		return textResponse("done")
+	})
+	do(t, request("GET", "/fast", nil))
+	if got := log.String(); got != "" {
+		t.Errorf("fast request logged %q", got)
+	}
+	do(t, request("GET", "/slow", nil))
+	if got := log.String(); !strings.Contains(got, "WARN Slow request: GET /slow") || !strings.Contains(got, "threshold 20ms") {
+		t.Errorf("log is %q, want a slow request warning for GET /slow", got)
+	}
+}
+
+func TestPipelinedRequestIDs(t *testing.T) {
+	keep := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	for _, tc := range []struct {
+		name, header string
+	}{{"generated", ""}, {"client's", "X-Request-Id: upstream-1\r\n"}} {
+		req := strings.Replace(keep, "\r\n\r\n", "\r\n"+tc.header+"\r\n", 1)
+		last := strings.Replace(request("GET", "/", nil), "\r\n\r\n", "\r\n"+tc.header+"\r\n", 1)
+		resps := parseResponses(t, exchange(t, req+req+last), "GET")
+		if len(resps) != 3 {
+			t.Fatalf("%s: got %d responses, want 3", tc.name, len(resps))
+		}
+		seen := map[string]bool{}
+		for i, resp := range resps {
+			id := resp.Header.Get("X-Request-Id")
+			if id == "" || seen[id] {
+				t.Errorf("%s: response %d has X-Request-Id %q, want a distinct one", tc.name, i+1, id)
+			}
+			seen[id] = true
+		}
+		if tc.header != "" && resps[0].Header.Get("X-Request-Id") != "upstream-1" {
+			t.Errorf("%s: first ID is %q, want the client's upstream-1", tc.name, resps[0].Header.Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestRequestIDMustBeToken(t *testing.T) {
+	resp, _ := do(t, request("GET", "/", []string{"X-Request-Id: not a token"}))
+	if id := resp.Header.Get("X-Request-Id"); id == "not a token" || len(id) != 32 {
+		t.Errorf("X-Request-Id is %q, want a generated one", id)
+	}
+}
+
+func TestRequestIDOnEveryResponse(t *testing.T) {
+	for _, raw := range []string{
+		"G(T / HTTP/1.1\r\nHost: localhost\r\n\r\n", // answered before there's a request
+		request("GET", "/drip?bytes=1&duration=0", nil),
+		request("GET", "/drip?bytes=-1", nil),
+		request("GET", "/events?count=1&interval=0", nil),
+		request("GET", "/events?count=x", nil),
+	} {
+		resp, _ := do(t, raw)
+		if resp.Header.Get("X-Request-Id") == "" {
+			t.Errorf("%q: %d response has no X-Request-Id", raw, resp.StatusCode)
+		}
+	}
+}
+
+func TestLogErrorsVerbose(t *testing.T) {
+	set(t, &logErrorsVerbose, true)
+	log := captureLog(t, levelError)
+	raw := "G(T /x HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if resp, _ := do(t, raw); resp.StatusCode != 400 {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	if got, want := log.String(), fmt.Sprintf("ERROR Error response 400 for request: %q", raw); !strings.Contains(got, want) {
+		t.Errorf("log is %q, want it to contain %q", got, want)
+	}
+
+	log = captureLog(t, levelError)
+	raw = request("GET", "/missing", []string{"X-Pad: " + strings.Repeat("p", maxLoggedRequestBytes)})
+	do(t, raw)
+	if got, want := log.String(), fmt.Sprintf("Error response 404 for request (truncated to %d bytes): %q", maxLoggedRequestBytes, raw[:maxLoggedRequestBytes]); !strings.Contains(got, want) {
+		t.Errorf("log is %q, want it to contain %q", got, want)
+	}
+
+	log = captureLog(t, levelError)
+	do(t, request("GET", "/", nil))
+	if got := log.String(); got != "" {
+		t.Errorf("a 200 logged %q", got)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if resp, _ := do(t, request("OPTIONS", "/nowhere", nil)); resp.StatusCode != 404 {
+		t.Errorf("OPTIONS /nowhere: status %d, want 404", resp.StatusCode)
+	}
+	resp, _ := do(t, request("OPTIONS", "/echo/x", nil))
+	if resp.StatusCode != 204 || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("OPTIONS /echo/x: status %d, Allow %q, want 204 with GET, HEAD, OPTIONS", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestUserAgentAccept(t *testing.T) {
+	resp, body := do(t, request("GET", "/user-agent", []string{"User-Agent: probe/1.0"}))
+	if resp.Header.Get("Content-Type") != "text/plain" || body != "probe/1.0" {
+		t.Errorf("no Accept: %q %q, want the plain user agent", resp.Header.Get("Content-Type"), body)
+	}
+	resp, body = do(t, request("GET", "/user-agent", []string{"User-Agent: probe/1.0", "Accept: text/html, application/json;q=0.9"}))
+	var got map[string]string
+	if resp.Header.Get("Content-Type") != "application/json" || json.Unmarshal([]byte(body), &got) != nil || got["user-agent"] != "probe/1.0" {
+		t.Errorf("Accept: application/json: %q %q, want a JSON object", resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestUserAgentMissing(t *testing.T) {
+	for _, strictMode := range []bool{false, true} {
+		set(t, &strict, strictMode)
+		for _, tc := range []struct {
+			headers []string
+			status  int
+			body    string
+		}{
+			{[]string{"User-Agent: probe/1.0"}, 200, "probe/1.0"},
+			{[]string{"User-Agent: "}, 200, ""},
+			{nil, map[bool]int{false: 200, true: 400}[strictMode], ""},
+		} {
+			resp, body := do(t, request("GET", "/user-agent", tc.headers))
+			if resp.StatusCode != tc.status || body != tc.body {
+				t.Errorf("strict %v, %q: got %d %q, want %d %q", strictMode, tc.headers, resp.StatusCode, body, tc.status, tc.body)
+			}
+		}
+	}
+}
+
+func TestRobots(t *testing.T) {
+	if resp, body := do(t, request("GET", "/robots.txt", nil)); resp.StatusCode != 200 || body != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("default: got %d %q", resp.StatusCode, body)
+	}
+	set(t, &robots, "User-agent: *\nAllow: /\n")
+	withRouter(t)
+	if resp, body := do(t, request("GET", "/robots.txt", nil)); resp.StatusCode != 200 || body != robots {
+		t.Errorf("configured: got %d %q, want %q", resp.StatusCode, body, robots)
+	}
+	set(t, &robots, "")
+	withRouter(t)
+	if resp, _ := do(t, request("GET", "/robots.txt", nil)); resp.StatusCode != 404 {
+		t.Errorf("disabled: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestEchoEmpty(t *testing.T) {
+	for _, path := range []string{"/echo", "/echo/"} {
+		if resp, body := do(t, request("GET", path, nil)); resp.StatusCode != 200 || body != "" {
+			t.Errorf("GET %s: got %d %q, want an empty 200", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	set(t, &redirects, pathMap{"/old": "/new", "/o301": "301:/n301", "/o302": "302:/n302", "/o307": "307:/n307", "/o308": "308:/n308"})
+	withRouter(t)
+	for path, want := range map[string]struct {
+		status   int
+		location string
+	}{"/old": {301, "/new"}, "/o301": {301, "/n301"}, "/o302": {302, "/n302"}, "/o307": {307, "/n307"}, "/o308": {308, "/n308"}} {
+		resp, _ := do(t, request("GET", path, nil))
+		if resp.StatusCode != want.status || resp.Header.Get("Location") != want.location {
+			t.Errorf("GET %s: %d to %q, want %d to %q", path, resp.StatusCode, resp.Header.Get("Location"), want.status, want.location)
+		}
+	}
+	for _, bad := range []string{"303:/x", "200:/x", ""} {
+		if _, _, err := parseRedirect(bad); err == nil {
+			t.Errorf("parseRedirect(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestEmptyContentLength(t *testing.T) {
+	if out := exchange(t, request("GET", "/", nil)); !strings.Contains(out, "\r\nContent-Length: 0\r\n") {
+		t.Errorf("response is %q, want an explicit Content-Length: 0", out)
+	}
+}
+
+func TestEchoQuery(t *testing.T) {
+	query := strings.Repeat("q", maxTargetLength-len("/echo/x?"))
+	if resp, body := do(t, request("GET", "/echo/x?"+query, nil)); resp.StatusCode != 200 || body != "x" {
+		t.Errorf("query at the limit: got %d %q, want x echoed", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, request("GET", "/echo/x?"+query+"q", nil)); resp.StatusCode != 414 {
+		t.Errorf("target over the limit: status %d, want 414", resp.StatusCode)
+	}
+}
+
+func TestNotFoundMessage(t *testing.T) {
+	if resp, body := do(t, request("GET", "/nowhere", nil)); resp.StatusCode != 404 || body != "" {
+		t.Errorf("default: got %d %q, want an empty 404", resp.StatusCode, body)
+	}
+	set(t, &notFoundMessage, "Nothing here\n")
+	resp, body := do(t, request("GET", "/nowhere", nil))
+	if resp.StatusCode != 404 || body != "Nothing here\n" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("configured: got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	set(t, &writeTimeout, 100*time.Millisecond)
+	c, done := pipe(t)
+	if _, err := io.WriteString(c, request("GET", "/bytes/100000", nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is read, so the first write blocks until its deadline.
+	start := time.Now()
+	select {
+	case <-done:
+		if took := time.Since(start); took < 50*time.Millisecond {
+			t.Errorf("handler gave up after %s, before -write-timeout", took)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still blocked writing to a client that isn't reading")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	text := strings.Repeat("compress-me-", 100)
+	resp, body := do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: deflate, gzip"}))
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("Content-Encoding %q, Content-Length %q for %d bytes, want gzip", resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Length"), len(body))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != text {
+		t.Errorf("decompressed %q, %v", plain, err)
+	}
+	if resp, body := do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: br"})); resp.Header.Get("Content-Encoding") != "" || body != text {
+		t.Errorf("without gzip accepted: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	set(t, &compress, func([]byte) ([]byte, error) { return nil, errors.New("out of memory") })
+	resp, body = do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: gzip"}))
+	if resp.Header.Get("Content-Encoding") != "" || body != text || resp.Header.Get("Content-Length") != strconv.Itoa(len(text)) {
+		t.Errorf("failed gzip: Content-Encoding %q, Content-Length %q, body of %d bytes, want the plain body", resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Length"), len(body))
+	}
+}
+
+func TestRandomBytes(t *testing.T) {
+	resp, body := do(t, request("GET", "/bytes/100", nil))
+	if resp.StatusCode != 200 || len(body) != 100 || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("got %d with %d bytes of %q, want 100", resp.StatusCode, len(body), resp.Header.Get("Content-Type"))
+	}
+	for _, count := range []string{"-1", "x", strconv.Itoa(maxRandomBytes + 1)} {
+		if resp, _ := do(t, request("GET", "/bytes/"+count, nil)); resp.StatusCode != 400 {
+			t.Errorf("/bytes/%s: status %d, want 400", count, resp.StatusCode)
+		}
+	}
+}
+
+func TestDrip(t *testing.T) {
+	start := time.Now()
+	resp, body := do(t, request("GET", "/drip?bytes=5&duration=0.25", nil))
+	took := time.Since(start)
+	if resp.StatusCode != 200 || body != "*****" || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("got %d %q %v, want 5 bytes chunked", resp.StatusCode, body, resp.TransferEncoding)
+	}
+	if took < 200*time.Millisecond || took > 2*time.Second {
+		t.Errorf("took %s, want about 250ms", took)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	set(t, &requestDeadline, 100*time.Millisecond)
+	withRouter(t)
+	release := make(chan struct{})
+	router.Handle("GET", "/slow", func(*Request, map[string]string) string {
+		<-release
+		return createResponse("200 OK", nil, "late")
+	})
+	c, done := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(c, request("GET", "/slow", nil))
+	start := time.Now()
+	out, err := io.ReadAll(c)
+	took := time.Since(start)
+	close(release)
+	<-done
+	if err != nil || len(out) > 0 {
+		t.Errorf("got %q, %v; want the connection closed with no response", out, err)
+	}
+	if took > 2*time.Second {
+		t.Errorf("connection closed after %s, want about 100ms", took)
+	}
+}
+
+func TestUserAgentGzip(t *testing.T) {
+	ua := strings.Repeat("agent/1.0 ", 50)
+	resp, body := do(t, request("GET", "/user-agent", []string{"User-Agent: " + ua, "Accept-Encoding: gzip"}))
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != strings.TrimSpace(ua) {
+		t.Errorf("decompressed %q, %v", plain, err)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	set(t, &maxRequestsPerConn, 2)
+	keep := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	resps := parseResponses(t, exchange(t, strings.Repeat(keep, 4)), "GET")
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses, want 2", len(resps))
+	}
+	if resps[0].Close || !resps[1].Close {
+		t.Errorf("Connection: close on the responses is %v, %v; want only on the last", resps[0].Close, resps[1].Close)
+	}
+}
+
+func TestStreamedHTTP10(t *testing.T) {
+	out := exchange(t, "GET /drip?bytes=3&duration=0 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	if strings.Contains(head, "Transfer-Encoding") || strings.Contains(head, "Content-Length") || !strings.Contains(head, "Connection: close") {
+		t.Errorf("head is %q, want no framing and Connection: close", head)
+	}
+	if body != "***" {
+		t.Errorf("body is %q, want the bytes up to the close", body)
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	set(t, &notFoundMessage, "gone")
+	if resp, body := do(t, request("GET", "/nowhere", nil)); resp.Header.Get("Content-Type") != "text/plain" || body != "gone" {
+		t.Errorf("text: got %q %q", resp.Header.Get("Content-Type"), body)
+	}
+	set(t, &errorFormat, "json")
+	for message, want := range map[string]string{"gone": `{"error":"gone","status":404}`, "": `{"error":"Not Found","status":404}`} {
+		set(t, &notFoundMessage, message)
+		if resp, body := do(t, request("GET", "/nowhere", nil)); resp.StatusCode != 404 || resp.Header.Get("Content-Type") != "application/json" || body != want {
+			t.Errorf("json, message %q: got %d %q %s, want %s", message, resp.StatusCode, resp.Header.Get("Content-Type"), body, want)
+		}
+	}
+}
+
+func TestPipelinedGetThenPost(t *testing.T) {
+	dir := withDir(t)
+	raw := "GET /echo/first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /files/up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nupload body" +
+		request("GET", "/echo/last", nil)
+	resps := parseResponses(t, exchange(t, raw), "GET")
+	if len(resps) != 3 || resps[0].body != "first" || resps[1].StatusCode != 201 || resps[2].body != "last" {
+		t.Fatalf("got %v, want the echo, a 201 and the echo", resps)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "up")); string(got) != "upload body" {
+		t.Errorf("file holds %q", got)
+	}
+}
+
+func TestDefaultEncoding(t *testing.T) {
+	text := strings.Repeat("compress-me-", 100)
+	raw := request("GET", "/echo/"+text, nil)
+	if resp, body := do(t, raw); resp.Header.Get("Content-Encoding") != "" || body != text {
+		t.Errorf("identity: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	set(t, &defaultEncoding, "gzip")
+	if resp, _ := do(t, raw); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("gzip: Content-Encoding %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	if resp, body := do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: identity"})); resp.Header.Get("Content-Encoding") != "" || body != text {
+		t.Errorf("gzip with Accept-Encoding: identity: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestMethodEndpoint(t *testing.T) {
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE", "PATCH", "TRACE"} {
+		if resp, body := do(t, request(method, "/method", nil)); resp.StatusCode != 200 || body != method {
+			t.Errorf("%s /method: got %d %q", method, resp.StatusCode, body)
+		}
+	}
+	if resp, body := do(t, request("POST", "/method", nil, "ignored")); body != "POST" {
+		t.Errorf("POST /method with a body: got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, request("HEAD", "/method", nil)); resp.StatusCode != 200 || resp.ContentLength != 4 {
+		t.Errorf("HEAD /method: got %d with length %d, want GET's head", resp.StatusCode, resp.ContentLength)
+	}
+}
+
+func TestKeepAliveFlushes(t *testing.T) {
+	c := dial(t)
+	br := bufio.NewReader(c)
+	for _, text := range []string{"one", "two"} {
+		if _, err := io.WriteString(c, "GET /echo/"+text+" HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second)) // well short of any timeout that would close the connection
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != text || resp.Close {
+			t.Errorf("got %q, close %v; want %q kept alive", body, resp.Close, text)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	resp, _ := do(t, request("GET", "/drip?bytes=2&duration=0", nil))
+	if resp.Header.Get("Trailer") != "" || len(resp.Trailer) > 0 {
+		t.Errorf("without TE: Trailer header %q, trailers %v", resp.Header.Get("Trailer"), resp.Trailer)
+	}
+	resp, body := do(t, request("GET", "/drip?bytes=2&duration=0", []string{"TE: deflate, trailers;q=1"}))
+	if body != "**" || resp.Trailer.Get("X-Drip-Duration") == "" {
+		t.Errorf("with TE: trailers: body %q, trailers %v", body, resp.Trailer)
+	}
+}
+
+func TestCompressionWarning(t *testing.T) {
+	text := strings.Repeat("compress-me-", 100)
+	if resp, _ := do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: gzip"})); resp.Header.Get("Warning") != "" {
+		t.Errorf("Warning %q on a compressed response", resp.Header.Get("Warning"))
+	}
+	set(t, &compress, func([]byte) ([]byte, error) { return nil, errors.New("out of memory") })
+	resp, _ := do(t, request("GET", "/echo/"+text, []string{"Accept-Encoding: gzip"}))
+	if resp.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(resp.Header.Get("Warning"), "199 ") {
+		t.Errorf("failed gzip: Content-Encoding %q, Warning %q; want a 199 warning", resp.Header.Get("Content-Encoding"), resp.Header.Get("Warning"))
+	}
+	if resp, _ := do(t, request("GET", "/echo/"+text, nil)); resp.Header.Get("Warning") != "" {
+		t.Errorf("Warning %q without gzip asked for", resp.Header.Get("Warning"))
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	logs := captureLog(t, levelWarn)
+	c, err := net.Dial("tcp", serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	if _, err := io.WriteString(c, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(br); err != nil || len(rest) > 0 {
+		t.Errorf("after the half-close: got %q, %v; want a clean EOF", rest, err)
+	}
+	if logs.String() != "" {
+		t.Errorf("logged %q", logs)
+	}
+}
+
+func TestConnectionByteCounts(t *testing.T) {
+	logs := captureLog(t, levelDebug)
+	keep := "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	raw := keep + keep + request("GET", "/bytes/100", nil)
+	out := exchange(t, raw)
+	if n := len(parseResponses(t, out, "GET")); n != 3 {
+		t.Fatalf("got %d responses, want 3", n)
+	}
+	want := fmt.Sprintf("closed: read %d bytes, wrote %d bytes", len(raw), len(out))
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("log has no %q:\n%s", want, logs)
+	}
+}
+
+func TestHeadGzipLength(t *testing.T) {
+	dir := withDir(t)
+	text := strings.Repeat("compress-me-", 100)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/echo/" + text, "/files/a.txt"} {
+		get, body := do(t, request("GET", target, []string{"Accept-Encoding: gzip"}))
+		head, _ := do(t, request("HEAD", target, []string{"Accept-Encoding: gzip"}))
+		if get.Header.Get("Content-Encoding") != "gzip" || head.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s: Content-Encoding %q on GET, %q on HEAD", target[:10], get.Header.Get("Content-Encoding"), head.Header.Get("Content-Encoding"))
+		}
+		if head.Header.Get("Content-Length") != strconv.Itoa(len(body)) || get.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s: Content-Length %q on HEAD, %q on GET, for %d gzipped bytes", target[:10], head.Header.Get("Content-Length"), get.Header.Get("Content-Length"), len(body))
+		}
+	}
+}
+
+func TestNoKeepAlive(t *testing.T) {
+	keep := "GET /echo/x HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"
+	if resps := parseResponses(t, exchange(t, keep+request("GET", "/echo/y", nil)), "GET"); len(resps) != 2 {
+		t.Fatalf("without the flag: got %d responses, want 2", len(resps))
+	}
+	set(t, &noKeepAlive, true)
+	resps := parseResponses(t, exchange(t, keep+request("GET", "/echo/y", nil)), "GET")
+	if len(resps) != 1 || !resps[0].Close {
+		t.Errorf("got %d responses, want one with Connection: close", len(resps))
+	}
+}
+
+func TestHeadEcho(t *testing.T) {
+	text := strings.Repeat("compress-me-", 100)
+	for _, headers := range [][]string{nil, {"Accept-Encoding: gzip"}} {
+		_, body := do(t, request("GET", "/echo/"+text, headers))
+		out := exchange(t, request("HEAD", "/echo/"+text, headers))
+		if resps := parseResponses(t, out, "HEAD"); len(resps) != 1 || resps[0].ContentLength != int64(len(body)) {
+			t.Errorf("%q: HEAD got %q, want GET's Content-Length %d", headers, out, len(body))
+		}
+		if _, rest, _ := strings.Cut(out, "\r\n\r\n"); rest != "" {
+			t.Errorf("%q: HEAD sent %d body bytes", headers, len(rest))
+		}
+	}
+}
+
+func TestHeaderCount(t *testing.T) {
+	headers := []string{"Accept: a", "Accept: b", "X-One: 1", "X-Two: 2"}
+	if resp, _ := do(t, request("GET", "/", headers)); resp.Header.Get("X-Request-Header-Count") != "" {
+		t.Errorf("without -debug-headers: X-Request-Header-Count %q", resp.Header.Get("X-Request-Header-Count"))
+	}
+	set(t, &debugHeaders, true)
+	resp, _ := do(t, request("GET", "/", headers))
+	if got := resp.Header.Get("X-Request-Header-Count"); got != "6" { // and Host and Connection, with repeats counted
+		t.Errorf("X-Request-Header-Count %q, want 6", got)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	c := dial(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	for _, text := range []string{"one", "two"} {
+		if _, err := io.WriteString(c, "GET /echo/"+text+" HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != text || resp.Header.Get("Connection") != "keep-alive" || !strings.HasPrefix(resp.Header.Get("Keep-Alive"), "timeout=") {
+			t.Errorf("%s: got %q with Connection %q, Keep-Alive %q", text, body, resp.Header.Get("Connection"), resp.Header.Get("Keep-Alive"))
+		}
+	}
+	if _, err := io.WriteString(c, "GET /echo/three HTTP/1.0\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(br) // to EOF, since without keep-alive HTTP/1.0 closes
+	if err != nil || !strings.HasSuffix(string(rest), "three") || strings.Contains(string(rest), "keep-alive") {
+		t.Errorf("without keep-alive: got %q, %v", rest, err)
+	}
+}
+
+func TestPersistentConnection(t *testing.T) {
+	set(t, &idleTimeout, 100*time.Millisecond)
+	c, done := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	for _, text := range []string{"one", "two"} {
+		if _, err := io.WriteString(c, "GET /echo/"+text+" HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != text || resp.Close {
+			t.Errorf("got %q, close %v; want %q on a kept-alive connection", body, resp.Close, text)
+		}
+	}
+	if rest, err := io.ReadAll(br); err != nil || len(rest) > 0 { // nothing more is sent, so it goes idle
+		t.Errorf("after going idle: got %q, %v; want the connection closed", rest, err)
+	}
+	<-done
+
+	resps := parseResponses(t, exchange(t, request("GET", "/echo/a", nil)+request("GET", "/echo/b", nil)), "GET")
+	if len(resps) != 1 || !resps[0].Close {
+		t.Errorf("Connection: close: got %d responses, want one that closes", len(resps))
+	}
+}
+
+func TestRequestDeadlineSkipsIdle(t *testing.T) {
+	set(t, &requestDeadline, 100*time.Millisecond)
+	c, _ := pipe(t)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	for i, text := range []string{"one", "two"} {
+		if i > 0 {
+			time.Sleep(250 * time.Millisecond) // idle between requests for longer than the deadline
+		}
+		if _, err := io.WriteString(c, "GET /echo/"+text+" HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != text {
+			t.Errorf("request %d: got %q, want %q", i+1, body, text)
+		}
+	}
+}
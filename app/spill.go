@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var errDigestMismatch = errors.New("body doesn't match Content-Digest")
+
+// spillBuffer holds a body in memory up to -upload-memory bytes and spills the
+// rest to a temp file, so a body can be read twice without memory growing with
+// its size.
+type spillBuffer struct {
+	mem  bytes.Buffer
+	file *os.File
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil {
+		if room := uploadMemory - int64(b.mem.Len()); int64(len(p)) <= room {
+			return b.mem.Write(p)
+		}
+		dir := uploadTmpDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		f, err := os.CreateTemp(dir, ".spill-*")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+	}
+	return b.file.Write(p)
+}
+
+// reader returns the whole buffered body from the start.
+func (b *spillBuffer) reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(b.mem.Bytes()), b.file), nil
+}
+
+// Close removes the spill file, if there is one.
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// verifiedBody reads body in full into a spillBuffer while hashing it,
+// and checks it against contentDigest, a Content-Digest (RFC 9530) header.
+// That way nothing is written under the target name until the body is known
+// good. If the header names no supported algorithm, it returns nil and body
+// streams as usual. The caller closes the buffer.
+func verifiedBody(body io.Reader, contentDigest string) (*spillBuffer, error) {
+	var h hash.Hash
+	var want []byte
+	for _, member := range strings.Split(contentDigest, ",") {
+		alg, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+		value, ok := strings.CutPrefix(value, ":")
+		value, ok2 := strings.CutSuffix(value, ":")
+		if !ok || !ok2 {
+			continue // not a byte sequence
+		}
+		newHash := map[string]func() hash.Hash{"sha-256": sha256.New, "sha-512": sha512.New}[strings.ToLower(alg)]
+		if newHash == nil {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Content-Digest: %w", err)
+		}
+		h, want = newHash(), digest
+		break
+	}
+	if h == nil {
+		return nil, nil
+	}
+	buf := &spillBuffer{}
+	if _, err := io.Copy(io.MultiWriter(buf, h), body); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		buf.Close()
+		return nil, errDigestMismatch
+	}
+	return buf, nil
+}
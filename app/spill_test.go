@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func contentDigest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "Content-Digest: sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// TestVerifiedUploadSpills uploads a body checked against Content-Digest that
+// is larger than -upload-memory, so most of it goes through a spill file.
+func TestVerifiedUploadSpills(t *testing.T) {
+	dir := withDir(t)
+	set(t, &uploadMemory, 1024)
+	set(t, &uploadTmpDir, t.TempDir())
+	body := strings.Repeat("0123456789", 10000)
+	if resp, _ := do(t, request("POST", "/files/spilled", []string{contentDigest(body)}, body)); resp.StatusCode != 201 {
+		t.Fatalf("status %d, want 201", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "spilled")); string(got) != body {
+		t.Errorf("stored %d bytes that differ from the %d uploaded", len(got), len(body))
+	}
+	if spills, _ := filepath.Glob(filepath.Join(uploadTmpDir, ".spill-*")); len(spills) > 0 {
+		t.Errorf("spill files left behind: %v", spills)
+	}
+
+	if resp, _ := do(t, request("POST", "/files/bad", []string{contentDigest("other")}, body)); resp.StatusCode != 400 {
+		t.Errorf("mismatched digest: status %d, want 400", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad")); err == nil {
+		t.Error("mismatched upload was stored")
+	}
+}
+
+// TestVerifiedUploadHoldsSlot stalls an upload while its digest is being
+// checked, which has to count against -max-uploads like any other.
+func TestVerifiedUploadHoldsSlot(t *testing.T) {
+	withDir(t)
+	set(t, &uploadSlots, make(chan struct{}, 1))
+	body := "slow body"
+	slow := dial(t)
+	slow.SetDeadline(time.Now().Add(5 * time.Second))
+	head := request("POST", "/files/slow", []string{contentDigest(body)}, body)
+	if _, err := io.WriteString(slow, head[:len(head)-4]); err != nil { // all but the body's last bytes
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(uploadSlots) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the stalled upload holds no slot")
+		}
+	}
+	if resp, _ := do(t, request("POST", "/files/other", nil, "x")); resp.StatusCode != 503 {
+		t.Errorf("second upload: status %d, want 503", resp.StatusCode)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var tlsFullHandshakes, tlsResumedHandshakes atomic.Int64
+
+// tlsConfig is set from -tls-cert and -tls-key, and replaced on SIGHUP.
+var tlsConfig atomic.Pointer[tls.Config]
+
+// overTLS reports whether con, as handed to serveRequest, is a TLS connection.
+func overTLS(con net.Conn) bool {
+	if c, ok := con.(*recordingConn); ok {
+		con = c.Conn
+	}
+	if c, ok := con.(*countingConn); ok {
+		con = c.Conn
+	}
+	_, ok := con.(*tls.Conn)
+	return ok
+}
+
+func init() {
+	metrics.register("tls_handshakes_full_total", tlsFullHandshakes.Load)
+	metrics.register("tls_handshakes_resumed_total", tlsResumedHandshakes.Load)
+}
+
+// handshake completes the TLS handshake on tc up front, within -idle-timeout,
+// and counts whether the client resumed an earlier session, which tells
+// operators whether session tickets are doing their job.
+func handshake(tc *tls.Conn) error {
+	if idleTimeout > 0 {
+		tc.SetDeadline(time.Now().Add(idleTimeout))
+		defer tc.SetDeadline(time.Time{})
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	if tc.ConnectionState().DidResume {
+		tlsResumedHandshakes.Add(1)
+	} else {
+		tlsFullHandshakes.Add(1)
+	}
+	return nil
+}
+
+// loadTLS reads the -tls-cert and -tls-key pair and makes it the certificate
+// for connections accepted from then on. Connections already open keep the
+// one they were accepted with, and the listeners stay bound throughout, so a
+// reload never drops a client. On error the current certificate stays.
+func loadTLS() error {
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"}, // ALPN, for clients that would otherwise try h2
+	}
+	if old := tlsConfig.Load(); old != nil {
+		cfg = old.Clone() // keeps the session ticket keys, so clients can still resume
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	tlsConfig.Store(cfg)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTLS serves TLS with a fresh self-signed certificate for 127.0.0.1,
+// written where -tls-cert and -tls-key point, until the test ends.
+func withTLS(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	set(t, &tlsCert, filepath.Join(dir, "cert.pem"))
+	set(t, &tlsKey, filepath.Join(dir, "key.pem"))
+	writeCert(t, "first")
+	if err := loadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tlsConfig.Store(nil) })
+}
+
+// writeCert writes a self-signed certificate with the given common name to
+// -tls-cert, and its key to -tls-key.
+func writeCert(t *testing.T, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tlsCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tlsKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialTLS connects to addr with cfg and has one request answered, by when
+// any session ticket has arrived.
+func dialTLS(t *testing.T, addr string, cfg *tls.Config) *tls.Conn {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, c)
+	return c
+}
+
+func TestTLSResumption(t *testing.T) {
+	withTLS(t)
+	addr := serve(t)
+	full, resumed := tlsFullHandshakes.Load(), tlsResumedHandshakes.Load()
+	cfg := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	if dialTLS(t, addr, cfg).ConnectionState().DidResume {
+		t.Fatal("the first connection resumed a session")
+	}
+	if !dialTLS(t, addr, cfg).ConnectionState().DidResume {
+		t.Fatal("the second connection didn't resume")
+	}
+	if got := tlsFullHandshakes.Load() - full; got != 1 {
+		t.Errorf("%d more full handshakes, want 1", got)
+	}
+	if got := tlsResumedHandshakes.Load() - resumed; got != 1 {
+		t.Errorf("%d more resumed handshakes, want 1", got)
+	}
+	if out := metrics.render(); !strings.Contains(out, "tls_handshakes_resumed_total ") {
+		t.Errorf("metrics lack the resumed count:\n%s", out)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	withTLS(t)
+	addr := serve(t)
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	old := dialTLS(t, addr, cfg)
+	writeCert(t, "second")
+	if err := loadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, old) // still served, on the certificate it was accepted with
+	if cn := old.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "first" {
+		t.Errorf("open connection's certificate is %q, want first", cn)
+	}
+	if cn := dialTLS(t, addr, cfg).ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "second" {
+		t.Errorf("new connection's certificate is %q, want second", cn)
+	}
+
+	os.WriteFile(tlsKey, []byte("garbage"), 0o600)
+	if err := loadTLS(); err == nil {
+		t.Fatal("loading a bad key succeeded")
+	}
+	if cn := dialTLS(t, addr, cfg).ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "second" {
+		t.Errorf("after a failed reload, the certificate is %q, want second", cn)
+	}
+}
+
+func TestPlainAndTLS(t *testing.T) {
+	withTLS(t)
+	s := NewServer([]string{"127.0.0.1:0"})
+	s.TLSAddrs = []string{"127.0.0.1:0"}
+	run(t, s)
+	plain, secure := s.listeners[0], s.listeners[1]
+	if plain.secure || !secure.secure {
+		t.Fatalf("listeners secure %v, %v; want plain then TLS", plain.secure, secure.secure)
+	}
+
+	c, err := net.Dial("tcp", plain.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, c)
+
+	state := dialTLS(t, secure.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}}).ConnectionState()
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("ALPN negotiated %q, want http/1.1", state.NegotiatedProtocol)
+	}
+	old := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}
+	if c, err := tls.Dial("tcp", secure.Addr().String(), old); err == nil {
+		c.Close()
+		t.Error("a TLS 1.1 handshake succeeded")
+	}
+}